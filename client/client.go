@@ -2,141 +2,292 @@ package client
 
 import (
 	"archive/tar"
-	"crypto/md5"
-	"encoding/hex"
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/craigfurman/ezxfer/protocol"
+	"github.com/craigfurman/ezxfer/ratelimit"
+	"github.com/craigfurman/ezxfer/tarstream"
 )
 
-const MD5_ATTRIBUTE_KEY = "md5"
+const MD5_ATTRIBUTE_KEY = tarstream.MD5AttributeKey
 
 type Client struct {
-	ProgressBarFactory ProgressBarFactory
+	// Observer, if set, is told of the progress of each send and get.
+	Observer Observer
+	// ConflictPolicy is requested from the server for files that already
+	// exist. The server's default is used if it is empty.
+	ConflictPolicy protocol.ConflictPolicy
+	// Token is presented to servers that require one.
+	Token string
+	// TLSFingerprint, if set, is the SHA-256 fingerprint of the server's
+	// certificate, and makes the client connect over TLS.
+	TLSFingerprint string
+	// BusyRetries is how many times a request is retried, after the delay
+	// the server asks for, when the server is too busy to accept it.
+	BusyRetries int
+	// Limiter, if set, limits the bandwidth of sends and gets.
+	Limiter *ratelimit.Limiter
+	// Streams, if more than 1, is how many connections directories, and
+	// files of at least StripeThreshold bytes, are sent over at once.
+	Streams int
+	// StripeThreshold is the size from which a single file is split between
+	// Streams. DefaultStripeThreshold is used if it is 0.
+	StripeThreshold int64
+	// Hashers is how many files are read and checksummed ahead of the one
+	// being sent on each stream.
+	Hashers int
+	// BufferSize is the size of the buffers files are read with.
+	BufferSize int
+	// SmallFileSize, if set, is the size below which the files of a directory
+	// are sent in batches, each checksummed as a whole, to servers that accept
+	// them.
+	SmallFileSize int64
 }
 
-//go:generate counterfeiter -o fakes/fake_progress_bar_factory.go . ProgressBarFactory
-type ProgressBarFactory interface {
-	New(fileSize int64) ProgressBar
-}
+// DefaultStripeThreshold is the size from which single files are striped
+// when sending over several streams.
+const DefaultStripeThreshold = 64 << 20
 
-type ProgressBar interface {
-	io.Writer
-	Finish()
-}
+// Send transfers a file, or a directory's contents, to dest. The result
+// records what the server did with each file.
+func (c *Client) Send(filePath string, dest Destination) (protocol.Result, error) {
+	info, err := os.Stat(filePath)
+	if err == nil && dest.Rename != "" && info.IsDir() {
+		err = errors.New("only a single file can be renamed on arrival")
+	}
 
-func (c *Client) Send(filePath, address string) error {
-	conn, err := net.Dial("tcp", address)
+	// The files are scanned first so that the totals of the transfer are
+	// known. Sends that fail before then are still reported as transfers.
+	var files int
+	var size int64
+	if err == nil {
+		files, size, err = tarstream.Count(filePath)
+	}
+	t := c.startTransfer(protocol.OpPut, files, size)
 	if err != nil {
-		return err
+		return t.done(protocol.Result{}, err)
 	}
 
-	tarStream := tar.NewWriter(conn)
-	defer conn.Close()
+	if c.Streams > 1 && info.IsDir() {
+		return t.done(c.sendParallel(t, filePath, dest))
+	}
+	if c.Streams > 1 && size > 0 && size >= c.stripeThreshold() {
+		return t.done(c.sendStriped(t, filePath, size, dest))
+	}
+	return t.done(c.sendStream(t, dest.Address, protocol.Request{
+		Op:             protocol.OpPut,
+		Path:           dest.Path,
+		Rename:         dest.Rename,
+		ConflictPolicy: c.ConflictPolicy,
+		Size:           size,
+	}, func(tarStream *tarstream.Writer) error {
+		return tarStream.WriteFiles(filePath)
+	}))
+}
 
-	info, err := os.Stat(filePath)
+func (c *Client) stripeThreshold() int64 {
+	if c.StripeThreshold == 0 {
+		return DefaultStripeThreshold
+	}
+	return c.StripeThreshold
+}
+
+// sendStream sends req, then the files that write writes to the tar stream,
+// and returns the server's result. The files are observed as part of t.
+func (c *Client) sendStream(t *transfer, address string, req protocol.Request, write func(*tarstream.Writer) error) (protocol.Result, error) {
+	conn, connReader, resp, err := c.request(address, req)
 	if err != nil {
-		return err
+		return protocol.Result{}, err
 	}
+	defer conn.Close()
 
-	if info.IsDir() {
-		if err := c.sendDir(filePath, tarStream); err != nil {
-			return err
-		}
-	} else {
-		if err := c.sendFile(filepath.Dir(filePath), filePath, tarStream); err != nil {
-			return err
-		}
+	tarStream := tarstream.NewWriter(ratelimit.NewWriter(conn, c.Limiter))
+	tarStream.Observer = t
+	tarStream.Hashers = c.Hashers
+	tarStream.BufferSize = c.BufferSize
+	if resp.Batches {
+		tarStream.SmallFileSize = c.SmallFileSize
+	}
+	// Files are sent with sendfile(2) over connections that are not
+	// encrypted.
+	_, tarStream.ZeroCopy = conn.(*net.TCPConn)
+	if err := write(tarStream); err != nil {
+		return protocol.Result{}, err
 	}
 	if err := tarStream.Close(); err != nil {
-		return fmt.Errorf("error closing tar stream: %s", err)
+		return protocol.Result{}, fmt.Errorf("error closing tar stream: %s", err)
 	}
-
-	reply, err := ioutil.ReadAll(conn)
-	if err != nil {
-		return fmt.Errorf("error reading reply: %s", err)
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := closer.CloseWrite(); err != nil {
+			return protocol.Result{}, fmt.Errorf("error closing tar stream: %s", err)
+		}
 	}
 
-	if string(reply) == "OK" {
-		return nil
+	var result protocol.Result
+	if err := protocol.ReadMessage(connReader, &result); err != nil {
+		return protocol.Result{}, fmt.Errorf("error reading result: %s", err)
 	}
+	if result.Error != "" {
+		return result, serverError(result.Error, result.Code, 0)
+	}
+	return result, nil
+}
 
-	return errors.New(string(reply))
+// Get downloads the file, or the directory's contents, at src.Path on the
+// server into localDir, and returns the paths of the files it saved.
+func (c *Client) Get(src Destination, localDir string) ([]string, error) {
+	t := c.startTransfer(protocol.OpGet, 0, 0)
+	saved, err := c.get(t, src, localDir)
+	t.finish(err)
+	return saved, err
 }
 
-func (c *Client) sendFile(basePath string, filePath string, tarStream *tar.Writer) error {
-	file, err := os.Open(filePath)
+func (c *Client) get(t *transfer, src Destination, localDir string) ([]string, error) {
+	conn, connReader, resp, err := c.request(src.Address, protocol.Request{Op: protocol.OpGet, Path: src.Path})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
+	defer conn.Close()
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return err
-	}
-	relativePath, err := filepath.Rel(basePath, filePath)
-	if err != nil {
-		return err
-	}
+	var saved []string
+	tarStream := tar.NewReader(ratelimit.NewReader(connReader, c.Limiter))
+	for {
+		header, err := tarStream.Next()
+		if err == io.EOF {
+			return saved, readGetResult(connReader, resp)
+		}
+		if err != nil {
+			return saved, fmt.Errorf("error reading tar stream: %s", err)
+		}
 
-	progressBar := c.ProgressBarFactory.New(fileInfo.Size())
-	progressTrackingFileReader := io.TeeReader(file, progressBar)
-	defer progressBar.Finish()
+		filePath := filepath.Join(localDir, filepath.FromSlash(header.Name))
+		if rel, err := filepath.Rel(localDir, filePath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return saved, fmt.Errorf("server sent path %s outside of %s", header.Name, localDir)
+		}
 
-	header, err := tar.FileInfoHeader(fileInfo, "What even is this? It seems to make no difference")
-	if err != nil {
-		return err
+		action := protocol.ActionCreated
+		if _, err := os.Lstat(filePath); err == nil {
+			action = protocol.ActionOverwritten
+		}
+		t.FileStarted(header.Name, header.Size)
+		if err := tarstream.ReceiveFile(io.TeeReader(tarStream, t.received(header.Name)), header, filePath); err != nil {
+			t.FileFailed(header.Name, err)
+			return saved, fmt.Errorf("%s: %w", header.Name, err)
+		}
+		t.verified(protocol.FileResult{Path: header.Name, Action: action})
+		saved = append(saved, filePath)
 	}
-	header.Name = relativePath
+}
 
-	md5Checksum, err := checksum(filePath)
-	if err != nil {
-		return err
+// readGetResult reads the result that servers which set resp.Results send
+// after the tar stream of a get, so that a get the server could not finish is
+// not taken for a whole one.
+func readGetResult(connReader *bufio.Reader, resp protocol.Response) error {
+	if !resp.Results {
+		return nil
 	}
-	header.Xattrs = map[string]string{MD5_ATTRIBUTE_KEY: md5Checksum}
-
-	if err := tarStream.WriteHeader(header); err != nil {
-		return err
+	var result protocol.Result
+	if err := protocol.ReadMessage(connReader, &result); err != nil {
+		return fmt.Errorf("error reading result: %s", err)
 	}
-
-	if _, err := io.Copy(tarStream, progressTrackingFileReader); err != nil {
-		return err
+	if result.Error != "" {
+		return serverError(result.Error, result.Code, 0)
 	}
-
 	return nil
 }
 
-func (c *Client) sendDir(filePath string, tarStream *tar.Writer) error {
-	return filepath.Walk(filePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			return nil
-		}
+type ListOptions struct {
+	// Recursive lists the whole tree rather than only immediate children.
+	Recursive bool
+	// Checksums includes each file's MD5 checksum.
+	Checksums bool
+}
 
-		return c.sendFile(filePath, path, tarStream)
+// List returns the files and directories at src.Path on the server.
+func (c *Client) List(src Destination, opts ListOptions) ([]protocol.Entry, error) {
+	conn, _, resp, err := c.request(src.Address, protocol.Request{
+		Op:        protocol.OpList,
+		Path:      src.Path,
+		Recursive: opts.Recursive,
+		Checksums: opts.Checksums,
 	})
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return resp.Entries, nil
+}
+
+// Remove deletes the file or directory at dest.Path on the server.
+// Directories that are not empty are only removed if recursive is set.
+func (c *Client) Remove(dest Destination, recursive bool) error {
+	return c.operation(dest.Address, protocol.Request{Op: protocol.OpRemove, Path: dest.Path, Recursive: recursive})
+}
+
+// Move moves the file or directory at src.Path on the server to the path to,
+// which is also relative to the server's root.
+func (c *Client) Move(src Destination, to string) error {
+	return c.operation(src.Address, protocol.Request{Op: protocol.OpMove, Path: src.Path, To: to})
+}
+
+// Mkdir creates the directory dest.Path, and any missing parents, on the
+// server.
+func (c *Client) Mkdir(dest Destination) error {
+	return c.operation(dest.Address, protocol.Request{Op: protocol.OpMkdir, Path: dest.Path})
 }
 
-func checksum(filePath string) (string, error) {
-	file, err := os.Open(filePath)
+// operation sends a request that the server answers with only a response.
+func (c *Client) operation(address string, req protocol.Request) error {
+	conn, _, _, err := c.request(address, req)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer file.Close()
+	return conn.Close()
+}
 
-	md5Writer := md5.New()
+// request connects to address and sends req, returning the connection and
+// the server's response once the server has accepted it. It retries up to
+// BusyRetries times while the server is busy.
+func (c *Client) request(address string, req protocol.Request) (net.Conn, *bufio.Reader, protocol.Response, error) {
+	for attempt := 0; ; attempt++ {
+		conn, connReader, resp, err := c.requestOnce(address, req)
+		busy, ok := err.(*BusyError)
+		if !ok || attempt >= c.BusyRetries {
+			return conn, connReader, resp, err
+		}
+		c.observe(Retrying{Attempt: attempt + 1, Delay: busy.RetryAfter, Err: err})
+		time.Sleep(busy.RetryAfter)
+	}
+}
 
-	if _, err := io.Copy(md5Writer, file); err != nil {
-		return "", err
+func (c *Client) requestOnce(address string, req protocol.Request) (net.Conn, *bufio.Reader, protocol.Response, error) {
+	var resp protocol.Response
+	req.Token = c.Token
+	conn, err := c.dial(address)
+	if err != nil {
+		return nil, nil, resp, err
 	}
+	connReader := bufio.NewReader(conn)
 
-	return hex.EncodeToString(md5Writer.Sum(nil)), nil
+	if err := protocol.WriteMessage(conn, req); err != nil {
+		conn.Close()
+		return nil, nil, resp, fmt.Errorf("error sending request: %s", err)
+	}
+	if err := protocol.ReadMessage(connReader, &resp); err != nil {
+		conn.Close()
+		return nil, nil, resp, fmt.Errorf("error reading response: %s", err)
+	}
+	if resp.Error != "" {
+		conn.Close()
+		return nil, nil, resp, serverError(resp.Error, resp.Code, resp.RetryAfter)
+	}
+	return conn, connReader, resp, nil
 }
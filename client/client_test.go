@@ -3,14 +3,19 @@ package client_test
 import (
 	"archive/tar"
 	"bufio"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/craigfurman/ezxfer/client"
 	"github.com/craigfurman/ezxfer/client/fakes"
+	"github.com/craigfurman/ezxfer/protocol"
+	"github.com/craigfurman/ezxfer/tarstream"
 	"github.com/craigfurman/ezxfer/testhelpers"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -21,16 +26,42 @@ var _ = Describe("sending files", func() {
 		tempDir  string
 		listener net.Listener
 
-		progressBarFactory *fakes.FakeProgressBarFactory
-		progressBar        *fakes.FakeProgressBar
-		c                  *client.Client
+		observer *fakes.FakeObserver
+		c        *client.Client
+		dest     client.Destination
 	)
 
+	// observed returns the events observed so far, without the durations of
+	// transfers.
+	observed := func() []client.Event {
+		var events []client.Event
+		for i := 0; i < observer.ObserveCallCount(); i++ {
+			event := observer.ObserveArgsForCall(i)
+			if done, ok := event.(client.TransferDone); ok {
+				Expect(done.Duration).To(BeNumerically(">", 0))
+				done.Duration = 0
+				event = done
+			}
+			events = append(events, event)
+		}
+		return events
+	}
+
+	acceptRequest := func(resp protocol.Response) (net.Conn, *bufio.Reader, protocol.Request) {
+		conn, err := listener.Accept()
+		Expect(err).NotTo(HaveOccurred())
+		connReader := bufio.NewReader(conn)
+
+		var req protocol.Request
+		Expect(protocol.ReadMessage(connReader, &req)).To(Succeed())
+		Expect(protocol.WriteMessage(conn, resp)).To(Succeed())
+		return conn, connReader, req
+	}
+
 	BeforeEach(func() {
-		progressBarFactory = new(fakes.FakeProgressBarFactory)
-		progressBar = fakes.NewFakeProgressBar()
-		progressBarFactory.NewReturns(progressBar)
-		c = &client.Client{ProgressBarFactory: progressBarFactory}
+		observer = new(fakes.FakeObserver)
+		c = &client.Client{Observer: observer}
+		dest = client.Destination{Address: "127.0.0.1:45454"}
 
 		var err error
 		tempDir, err = ioutil.TempDir("", "ezxfer-tests")
@@ -45,19 +76,21 @@ var _ = Describe("sending files", func() {
 		Expect(os.RemoveAll(tempDir)).To(Succeed())
 	})
 
-	Context("when the server replies OK after receiving the tar stream", func() {
+	Context("when the server replies with a result after receiving the tar stream", func() {
 		It("send the files to the server", func() {
+			results := make(chan protocol.Result)
 			errs := make(chan error)
 
 			go func() {
-				errs <- c.Send(filepath.Join(tempDir), "127.0.0.1:45454")
+				result, err := c.Send(filepath.Join(tempDir), dest)
+				results <- result
+				errs <- err
 			}()
 
-			conn, err := listener.Accept()
-			Expect(err).NotTo(HaveOccurred())
+			conn, connReader, _ := acceptRequest(protocol.Response{})
 			defer conn.Close()
 
-			tarStream := tar.NewReader(conn)
+			tarStream := tar.NewReader(connReader)
 			header, err := tarStream.Next()
 			Expect(err).NotTo(HaveOccurred())
 			Expect(header.Name).To(Equal("subdirectory/a_file.txt"))
@@ -70,18 +103,93 @@ var _ = Describe("sending files", func() {
 			_, err = tarStream.Next()
 			Expect(err).To(MatchError(io.EOF))
 
-			connWriter := bufio.NewWriter(conn)
-			_, err = connWriter.WriteString("OK")
-			Expect(err).NotTo(HaveOccurred())
-			Expect(connWriter.Flush()).To(Succeed())
+			result := protocol.Result{Files: []protocol.FileResult{
+				{Path: "subdirectory/a_file.txt", Action: protocol.ActionRenamed, SavedAs: "subdirectory/a_file.1.txt"},
+			}}
+			Expect(protocol.WriteMessage(conn, result)).To(Succeed())
 			Expect(conn.Close()).To(Succeed())
 
+			Expect(<-results).To(Equal(result))
+			Expect(<-errs).NotTo(HaveOccurred())
+
+			Expect(observed()).To(Equal([]client.Event{
+				client.TransferStarted{Op: protocol.OpPut, Files: 1, Size: 13},
+				client.FileStarted{Path: "subdirectory/a_file.txt", Size: 13},
+				client.BytesSent{Path: "subdirectory/a_file.txt", N: 13},
+				client.FileVerified{Path: "subdirectory/a_file.txt", Action: protocol.ActionRenamed, SavedAs: "subdirectory/a_file.1.txt"},
+				client.TransferDone{Files: 1, Bytes: 13},
+			}))
+		})
+	})
+
+	Context("when totalling the progress of the transfer", func() {
+		It("scans the files first, and counts each as it is sent", func() {
+			progress := new(client.Progress)
+			c.Observer = progress
+			errs := make(chan error, 1)
+			go func() {
+				_, err := c.Send(tempDir, dest)
+				errs <- err
+			}()
+
+			conn, connReader, _ := acceptRequest(protocol.Response{})
+			defer conn.Close()
+			_, err := io.Copy(ioutil.Discard, connReader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(protocol.WriteMessage(conn, protocol.Result{})).To(Succeed())
+			Expect(<-errs).NotTo(HaveOccurred())
+
+			snapshot := progress.Snapshot()
+			Expect(snapshot.Current).To(Equal("subdirectory/a_file.txt"))
+			Expect([]int{snapshot.FilesDone, snapshot.Files}).To(Equal([]int{1, 1}))
+			Expect([]int64{snapshot.Sent, snapshot.Size}).To(Equal([]int64{13, 13}))
+		})
+	})
+
+	Context("when small files are to be batched", func() {
+		BeforeEach(func() {
+			c.SmallFileSize = 1024
+			Expect(testhelpers.CreateFile("more content\n", tempDir, "b_file.txt")).To(Succeed())
+		})
+
+		sendAndReadEntries := func(resp protocol.Response) []*tar.Header {
+			errs := make(chan error, 1)
+			go func() {
+				_, err := c.Send(tempDir, dest)
+				errs <- err
+			}()
+
+			conn, connReader, _ := acceptRequest(resp)
+			defer conn.Close()
+			var headers []*tar.Header
+			tarStream := tar.NewReader(connReader)
+			for {
+				header, err := tarStream.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+				headers = append(headers, header)
+			}
+			Expect(protocol.WriteMessage(conn, protocol.Result{})).To(Succeed())
 			Expect(<-errs).NotTo(HaveOccurred())
+			return headers
+		}
 
-			Expect(progressBarFactory.NewCallCount()).To(Equal(1))
-			Expect(progressBarFactory.NewArgsForCall(0)).To(Equal(int64(13)))
-			Expect(progressBar.String()).To(Equal("some content\n"))
-			Expect(progressBar.FinishCallCount()).To(Equal(1))
+		It("sends them in a single batch to servers that accept batches", func() {
+			headers := sendAndReadEntries(protocol.Response{Batches: true})
+			Expect(headers).To(HaveLen(1))
+			Expect(tarstream.IsBatch(headers[0])).To(BeTrue())
+			Expect(headers[0].Xattrs[tarstream.BatchAttributeKey]).To(Equal("2"))
+			Expect(observed()).To(ContainElement(client.FileStarted{Path: "b_file.txt", Size: 13}))
+			Expect(observed()).To(ContainElement(client.BytesSent{Path: "subdirectory/a_file.txt", N: 13}))
+		})
+
+		It("sends them one at a time to other servers", func() {
+			headers := sendAndReadEntries(protocol.Response{})
+			Expect(headers).To(HaveLen(2))
+			Expect(headers[0].Name).To(Equal("b_file.txt"))
+			Expect(headers[1].Name).To(Equal("subdirectory/a_file.txt"))
 		})
 	})
 
@@ -90,29 +198,500 @@ var _ = Describe("sending files", func() {
 			errs := make(chan error)
 
 			go func() {
-				errs <- c.Send(filepath.Join(tempDir), "127.0.0.1:45454")
+				_, err := c.Send(filepath.Join(tempDir), dest)
+				errs <- err
 			}()
 
-			conn, err := listener.Accept()
-			Expect(err).NotTo(HaveOccurred())
+			conn, connReader, _ := acceptRequest(protocol.Response{})
 			defer conn.Close()
 
-			tarStream := tar.NewReader(conn)
-			_, err = tarStream.Next()
+			tarStream := tar.NewReader(connReader)
+			_, err := tarStream.Next()
 			Expect(err).NotTo(HaveOccurred())
 			_, err = ioutil.ReadAll(tarStream)
 			Expect(err).NotTo(HaveOccurred())
 			_, err = tarStream.Next()
 			Expect(err).To(MatchError(io.EOF))
 
-			connWriter := bufio.NewWriter(conn)
 			errMsg := "something went wrong"
-			_, err = connWriter.WriteString(errMsg)
-			Expect(err).NotTo(HaveOccurred())
-			Expect(connWriter.Flush()).To(Succeed())
+			Expect(protocol.WriteMessage(conn, protocol.Result{Error: errMsg})).To(Succeed())
 			Expect(conn.Close()).To(Succeed())
 
 			Expect(<-errs).To(MatchError(errMsg))
 		})
 	})
+
+	Context("when sending to a remote path", func() {
+		It("asks the server to save the files there", func() {
+			dest.Path = "/incoming/build-42"
+			dest.Rename = "renamed.txt"
+			c.ConflictPolicy = protocol.ConflictRename
+			errs := make(chan error)
+
+			go func() {
+				_, err := c.Send(filepath.Join(tempDir, "subdirectory", "a_file.txt"), dest)
+				errs <- err
+			}()
+
+			conn, connReader, req := acceptRequest(protocol.Response{})
+			defer conn.Close()
+			Expect(req).To(Equal(protocol.Request{Op: protocol.OpPut, Path: "/incoming/build-42", Rename: "renamed.txt", ConflictPolicy: protocol.ConflictRename, Size: 13}))
+
+			_, err := ioutil.ReadAll(connReader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(protocol.WriteMessage(conn, protocol.Result{})).To(Succeed())
+			Expect(conn.Close()).To(Succeed())
+
+			Expect(<-errs).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("when the server refuses the request", func() {
+		It("returns the server's error without sending any files", func() {
+			errs := make(chan error)
+
+			go func() {
+				_, err := c.Send(filepath.Join(tempDir), dest)
+				errs <- err
+			}()
+
+			conn, _, _ := acceptRequest(protocol.Response{Error: "path ../.. is outside of the server root"})
+			defer conn.Close()
+
+			err := <-errs
+			Expect(err).To(MatchError("path ../.. is outside of the server root"))
+			Expect(observed()).To(Equal([]client.Event{
+				client.TransferStarted{Op: protocol.OpPut, Files: 1, Size: 13},
+				client.TransferDone{Err: err},
+			}))
+		})
+	})
+
+	Context("when asked to rename a directory", func() {
+		It("returns an error", func() {
+			dest.Rename = "renamed"
+			_, err := c.Send(tempDir, dest)
+			Expect(err).To(MatchError("only a single file can be renamed on arrival"))
+			Expect(observed()).To(Equal([]client.Event{
+				client.TransferStarted{Op: protocol.OpPut},
+				client.TransferDone{Err: err},
+			}))
+		})
+	})
+
+	Context("when the file to send does not exist", func() {
+		It("reports the failed transfer", func() {
+			_, err := c.Send(filepath.Join(tempDir, "nope"), dest)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			Expect(observed()).To(Equal([]client.Event{
+				client.TransferStarted{Op: protocol.OpPut},
+				client.TransferDone{Err: err},
+			}))
+		})
+	})
+
+	Describe("getting files", func() {
+		var localDir string
+
+		BeforeEach(func() {
+			localDir = filepath.Join(tempDir, "local")
+			dest.Path = "/logs"
+		})
+
+		serveResult := func(writeStream func(*tar.Writer), result protocol.Result) {
+			defer GinkgoRecover()
+			conn, _, req := acceptRequest(protocol.Response{Results: true})
+			defer conn.Close()
+			Expect(req).To(Equal(protocol.Request{Op: protocol.OpGet, Path: "/logs"}))
+
+			tarStream := tar.NewWriter(conn)
+			writeStream(tarStream)
+			Expect(tarStream.Close()).To(Succeed())
+			Expect(protocol.WriteMessage(conn, result)).To(Succeed())
+		}
+
+		serve := func(writeStream func(*tar.Writer)) {
+			serveResult(writeStream, protocol.Result{})
+		}
+
+		writeEntry := func(tarStream *tar.Writer, name, content, md5 string) {
+			Expect(tarStream.WriteHeader(&tar.Header{
+				Name:   name,
+				Mode:   0644,
+				Size:   int64(len(content)),
+				Xattrs: map[string]string{client.MD5_ATTRIBUTE_KEY: md5},
+			})).To(Succeed())
+			_, err := tarStream.Write([]byte(content))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		It("saves the files the server sends into the local directory", func() {
+			go serve(func(tarStream *tar.Writer) {
+				writeEntry(tarStream, "d1/a_file.txt", "some content\n", "eb9c2bf0eb63f3a7bc0ea37ef18aeba5")
+			})
+
+			saved, err := c.Get(dest, localDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(saved).To(Equal([]string{filepath.Join(localDir, "d1", "a_file.txt")}))
+			Expect(ioutil.ReadFile(filepath.Join(localDir, "d1", "a_file.txt"))).To(Equal([]byte("some content\n")))
+
+			Expect(observed()).To(Equal([]client.Event{
+				client.TransferStarted{Op: protocol.OpGet},
+				client.FileStarted{Path: "d1/a_file.txt", Size: 13},
+				client.BytesSent{Path: "d1/a_file.txt", N: 13},
+				client.FileVerified{Path: "d1/a_file.txt", Action: protocol.ActionCreated},
+				client.TransferDone{Files: 1, Bytes: 13},
+			}))
+		})
+
+		It("returns the server's error when it could not send every file", func() {
+			go serveResult(func(tarStream *tar.Writer) {
+				writeEntry(tarStream, "a_file.txt", "some content\n", "eb9c2bf0eb63f3a7bc0ea37ef18aeba5")
+			}, protocol.Result{Error: "open logs/b_file.txt: permission denied", Code: protocol.CodePermissionDenied})
+
+			saved, err := c.Get(dest, localDir)
+			Expect(err).To(MatchError("open logs/b_file.txt: permission denied"))
+			Expect(saved).To(Equal([]string{filepath.Join(localDir, "a_file.txt")}))
+			Expect(observed()).To(ContainElement(client.TransferDone{Files: 1, Bytes: 13, Err: err}))
+		})
+
+		It("returns an error when the server does not say that it sent every file", func() {
+			go func() {
+				defer GinkgoRecover()
+				conn, _, _ := acceptRequest(protocol.Response{Results: true})
+				defer conn.Close()
+				tarStream := tar.NewWriter(conn)
+				writeEntry(tarStream, "a_file.txt", "some content\n", "eb9c2bf0eb63f3a7bc0ea37ef18aeba5")
+				Expect(tarStream.Close()).To(Succeed())
+			}()
+
+			_, err := c.Get(dest, localDir)
+			Expect(err).To(MatchError("error reading result: EOF"))
+		})
+
+		It("returns an error when the tar stream ends part way through", func() {
+			go func() {
+				defer GinkgoRecover()
+				conn, _, _ := acceptRequest(protocol.Response{Results: true})
+				defer conn.Close()
+				tarStream := tar.NewWriter(conn)
+				Expect(tarStream.WriteHeader(&tar.Header{Name: "a_file.txt", Mode: 0644, Size: 13})).To(Succeed())
+				_, err := tarStream.Write([]byte("some"))
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			_, err := c.Get(dest, localDir)
+			Expect(err).To(MatchError("a_file.txt: unexpected EOF"))
+		})
+
+		It("returns an error when a checksum does not match", func() {
+			go serve(func(tarStream *tar.Writer) {
+				writeEntry(tarStream, "a_file.txt", "some content\n", "wrong")
+			})
+
+			_, err := c.Get(dest, localDir)
+			Expect(err).To(MatchError("a_file.txt: md5 does not match: expected wrong, got eb9c2bf0eb63f3a7bc0ea37ef18aeba5"))
+			Expect(observed()).To(ContainElement(client.FileFailed{Path: "a_file.txt", Err: errors.Unwrap(err)}))
+		})
+
+		It("refuses paths outside of the local directory", func() {
+			go serve(func(tarStream *tar.Writer) {
+				writeEntry(tarStream, "../escaped.txt", "some content\n", "eb9c2bf0eb63f3a7bc0ea37ef18aeba5")
+			})
+
+			_, err := c.Get(dest, localDir)
+			Expect(err).To(MatchError(ContainSubstring("server sent path ../escaped.txt outside of")))
+			Expect(filepath.Join(tempDir, "escaped.txt")).NotTo(BeAnExistingFile())
+		})
+
+		It("returns the server's error when it refuses the request", func() {
+			go func() {
+				defer GinkgoRecover()
+				conn, _, _ := acceptRequest(protocol.Response{Error: "read access is not allowed"})
+				conn.Close()
+			}()
+
+			_, err := c.Get(dest, localDir)
+			Expect(err).To(MatchError("read access is not allowed"))
+		})
+	})
+
+	Describe("listing files", func() {
+		It("asks the server for a listing and returns its entries", func() {
+			dest.Path = "/logs"
+			entries := []protocol.Entry{{Path: "a.txt", Size: 13, Mode: 0644, MD5: "eb9c2bf0eb63f3a7bc0ea37ef18aeba5"}}
+			reqs := make(chan protocol.Request, 1)
+			go func() {
+				defer GinkgoRecover()
+				conn, _, req := acceptRequest(protocol.Response{Entries: entries})
+				conn.Close()
+				reqs <- req
+			}()
+
+			Expect(c.List(dest, client.ListOptions{Recursive: true, Checksums: true})).To(Equal(entries))
+			Expect(<-reqs).To(Equal(protocol.Request{Op: protocol.OpList, Path: "/logs", Recursive: true, Checksums: true}))
+		})
+
+		It("returns the server's error when it refuses the request", func() {
+			go func() {
+				defer GinkgoRecover()
+				conn, _, _ := acceptRequest(protocol.Response{Error: "nope does not exist"})
+				conn.Close()
+			}()
+
+			_, err := c.List(dest, client.ListOptions{})
+			Expect(err).To(MatchError("nope does not exist"))
+		})
+	})
+
+	Context("when sending a directory over several streams", func() {
+		BeforeEach(func() {
+			c.Streams = 2
+			Expect(os.RemoveAll(filepath.Join(tempDir, "subdirectory"))).To(Succeed())
+			for name, size := range map[string]int{"big": 100, "mid": 60, "small1": 50, "small2": 10} {
+				Expect(testhelpers.CreateFile(strings.Repeat("x", size), tempDir, name)).To(Succeed())
+			}
+		})
+
+		It("sends the largest files first, balanced between the streams, as one transfer", func() {
+			results := make(chan protocol.Result, 1)
+			go func() {
+				defer GinkgoRecover()
+				result, err := c.Send(tempDir, dest)
+				Expect(err).NotTo(HaveOccurred())
+				results <- result
+			}()
+
+			combined := protocol.Result{Files: []protocol.FileResult{{Path: "big"}, {Path: "mid"}, {Path: "small1"}, {Path: "small2"}}}
+			var (
+				reqs    []protocol.Request
+				streams [][]string
+			)
+			for i := 0; i < 2; i++ {
+				conn, connReader, req := acceptRequest(protocol.Response{})
+				defer conn.Close()
+				reqs = append(reqs, req)
+
+				var names []string
+				tarStream := tar.NewReader(connReader)
+				for {
+					header, err := tarStream.Next()
+					if err == io.EOF {
+						break
+					}
+					Expect(err).NotTo(HaveOccurred())
+					names = append(names, header.Name)
+				}
+				streams = append(streams, names)
+				Expect(protocol.WriteMessage(conn, combined)).To(Succeed())
+			}
+
+			Expect(reqs[0].TransferID).NotTo(BeEmpty())
+			Expect(reqs[1].TransferID).To(Equal(reqs[0].TransferID))
+			Expect(reqs[0].Streams).To(Equal(2))
+			Expect([]int64{reqs[0].Size, reqs[1].Size}).To(ConsistOf(int64(110), int64(110)))
+			Expect(streams).To(ConsistOf([]string{"big", "small2"}, []string{"mid", "small1"}))
+			Expect(<-results).To(Equal(combined))
+		})
+	})
+
+	Context("when sending a large file over several streams", func() {
+		var filePath string
+
+		BeforeEach(func() {
+			c.Streams = 3
+			c.StripeThreshold = 10
+			filePath = filepath.Join(tempDir, "big")
+			Expect(testhelpers.CreateFile("0123456789abcdefghij", filePath)).To(Succeed())
+		})
+
+		It("sends a byte range of the file over each stream, as one transfer", func() {
+			progress := new(client.Progress)
+			observer.ObserveStub = progress.Observe
+			results := make(chan protocol.Result, 1)
+			go func() {
+				defer GinkgoRecover()
+				result, err := c.Send(filePath, dest)
+				Expect(err).NotTo(HaveOccurred())
+				results <- result
+			}()
+
+			combined := protocol.Result{Files: []protocol.FileResult{{Path: "big"}}}
+			ranges := map[int64]string{}
+			var transferIDs []string
+			for i := 0; i < 3; i++ {
+				conn, connReader, req := acceptRequest(protocol.Response{})
+				defer conn.Close()
+				Expect(req.Streams).To(Equal(3))
+				Expect(req.Stripe).NotTo(BeNil())
+				Expect(req.Stripe.FileSize).To(Equal(int64(20)))
+				Expect(req.Size).To(Equal(req.Stripe.Length))
+				transferIDs = append(transferIDs, req.TransferID)
+
+				tarStream := tar.NewReader(connReader)
+				header, err := tarStream.Next()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(header.Name).To(Equal("big"))
+				Expect(header.Xattrs[client.MD5_ATTRIBUTE_KEY]).To(Equal("644be06dfc54061fd1e67f5ebbabcd58"))
+				content, err := ioutil.ReadAll(tarStream)
+				Expect(err).NotTo(HaveOccurred())
+				ranges[req.Stripe.Offset] = string(content)
+				Expect(protocol.WriteMessage(conn, combined)).To(Succeed())
+			}
+
+			Expect(transferIDs[1]).To(Equal(transferIDs[0]))
+			Expect(transferIDs[2]).To(Equal(transferIDs[0]))
+			Expect(ranges).To(Equal(map[int64]string{0: "0123456", 7: "789abcd", 14: "efghij"}))
+			Expect(<-results).To(Equal(combined))
+
+			var started []client.Event
+			for _, event := range observed() {
+				if _, ok := event.(client.FileStarted); ok {
+					started = append(started, event)
+				}
+			}
+			Expect(started).To(Equal([]client.Event{client.FileStarted{Path: "big", Size: 20}}))
+			Expect(progress.Snapshot().FilesDone).To(Equal(1))
+		})
+	})
+
+	Describe("server errors", func() {
+		It("can be matched by their code", func() {
+			go func() {
+				defer GinkgoRecover()
+				conn, _, _ := acceptRequest(protocol.Response{Error: "not enough space: 1GB to send, 1MB available", Code: protocol.CodeNoSpace})
+				conn.Close()
+			}()
+
+			_, err := c.Send(tempDir, dest)
+			Expect(err).To(MatchError("not enough space: 1GB to send, 1MB available"))
+			Expect(errors.Is(err, client.ErrNoSpace)).To(BeTrue())
+			Expect(errors.Is(err, client.ErrPermissionDenied)).To(BeFalse())
+
+			var serverErr *client.ServerError
+			Expect(errors.As(err, &serverErr)).To(BeTrue())
+			Expect(serverErr.Code).To(Equal(protocol.CodeNoSpace))
+		})
+
+		It("are matched in results sent after the files", func() {
+			errs := make(chan error)
+			go func() {
+				_, err := c.Send(tempDir, dest)
+				errs <- err
+			}()
+
+			conn, connReader, _ := acceptRequest(protocol.Response{})
+			defer conn.Close()
+			_, err := ioutil.ReadAll(connReader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(protocol.WriteMessage(conn, protocol.Result{Error: "md5 does not match", Code: protocol.CodeChecksum})).To(Succeed())
+			Expect(conn.Close()).To(Succeed())
+
+			Expect(errors.Is(<-errs, client.ErrChecksumMismatch)).To(BeTrue())
+		})
+
+		It("are internal errors when the server sends no code", func() {
+			go func() {
+				defer GinkgoRecover()
+				conn, _, _ := acceptRequest(protocol.Response{Error: "something went wrong"})
+				conn.Close()
+			}()
+
+			Expect(errors.Is(c.Mkdir(dest), client.ErrInternal)).To(BeTrue())
+		})
+	})
+
+	Describe("when the server is busy", func() {
+		busy := protocol.Response{Error: "server busy, retry after 1 seconds", RetryAfter: 1}
+
+		It("returns a BusyError", func() {
+			go func() {
+				defer GinkgoRecover()
+				conn, _, _ := acceptRequest(busy)
+				conn.Close()
+			}()
+
+			err := c.Mkdir(dest)
+			Expect(err).To(MatchError("server busy, retry after 1 seconds"))
+			Expect(err).To(BeAssignableToTypeOf(&client.BusyError{}))
+			Expect(err.(*client.BusyError).RetryAfter).To(Equal(time.Second))
+			Expect(errors.Is(err, client.ErrBusy)).To(BeTrue())
+		})
+
+		It("retries after the delay the server asks for", func() {
+			c.BusyRetries = 1
+			go func() {
+				defer GinkgoRecover()
+				conn, _, _ := acceptRequest(busy)
+				conn.Close()
+				conn, _, _ = acceptRequest(protocol.Response{})
+				conn.Close()
+			}()
+
+			start := time.Now()
+			Expect(c.Mkdir(dest)).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+			Expect(observer.ObserveCallCount()).To(Equal(1))
+			retrying := observer.ObserveArgsForCall(0).(client.Retrying)
+			Expect(retrying.Attempt).To(Equal(1))
+			Expect(retrying.Delay).To(Equal(time.Second))
+			Expect(retrying.Err).To(MatchError("server busy, retry after 1 seconds"))
+		})
+
+		It("retries servers that are busy without saying for how long", func() {
+			c.BusyRetries = 1
+			go func() {
+				defer GinkgoRecover()
+				conn, _, _ := acceptRequest(protocol.Response{Error: "server is shutting down", Code: protocol.CodeBusy})
+				conn.Close()
+				conn, _, _ = acceptRequest(protocol.Response{})
+				conn.Close()
+			}()
+
+			Expect(c.Mkdir(dest)).To(Succeed())
+			Expect(observer.ObserveCallCount()).To(Equal(1))
+			Expect(observer.ObserveArgsForCall(0).(client.Retrying).Delay).To(Equal(time.Second))
+		})
+	})
+
+	Describe("changing files", func() {
+		var reqs chan protocol.Request
+
+		BeforeEach(func() {
+			dest.Path = "logs/a.txt"
+			reqs = make(chan protocol.Request, 1)
+		})
+
+		serve := func(resp protocol.Response) {
+			go func() {
+				defer GinkgoRecover()
+				conn, _, req := acceptRequest(resp)
+				conn.Close()
+				reqs <- req
+			}()
+		}
+
+		It("asks the server to remove a path", func() {
+			serve(protocol.Response{})
+			Expect(c.Remove(dest, true)).To(Succeed())
+			Expect(<-reqs).To(Equal(protocol.Request{Op: protocol.OpRemove, Path: "logs/a.txt", Recursive: true}))
+		})
+
+		It("asks the server to move a path", func() {
+			serve(protocol.Response{})
+			Expect(c.Move(dest, "archive/a.txt")).To(Succeed())
+			Expect(<-reqs).To(Equal(protocol.Request{Op: protocol.OpMove, Path: "logs/a.txt", To: "archive/a.txt"}))
+		})
+
+		It("asks the server to make a directory", func() {
+			serve(protocol.Response{})
+			Expect(c.Mkdir(dest)).To(Succeed())
+			Expect(<-reqs).To(Equal(protocol.Request{Op: protocol.OpMkdir, Path: "logs/a.txt"}))
+		})
+
+		It("returns the server's error", func() {
+			serve(protocol.Response{Error: "rm is not allowed"})
+			Expect(c.Remove(dest, false)).To(MatchError("rm is not allowed"))
+		})
+	})
 })
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Destination identifies where on a server files are sent to.
+type Destination struct {
+	// Address is the server's host:port.
+	Address string
+	// Path is the directory, relative to the server's root, to write files
+	// to. The server's root is used if it is empty.
+	Path string
+	// Rename, if set, is the name a single file is saved under on arrival.
+	Rename string
+}
+
+// ParseDestination parses destinations of the form host:port or
+// host:port:/remote/path.
+func ParseDestination(dest string) (Destination, error) {
+	hostEnd := strings.Index(dest, ":")
+	if strings.HasPrefix(dest, "[") {
+		hostEnd = strings.Index(dest, "]:") + 1
+	}
+	if hostEnd <= 0 {
+		return Destination{}, fmt.Errorf("invalid destination %q: expected host:port[:path]", dest)
+	}
+
+	host := dest[:hostEnd]
+	port, path := dest[hostEnd+1:], ""
+	if i := strings.Index(port, ":"); i >= 0 {
+		port, path = port[:i], port[i+1:]
+	}
+	if port == "" {
+		return Destination{}, fmt.Errorf("invalid destination %q: missing port", dest)
+	}
+
+	return Destination{
+		Address: net.JoinHostPort(strings.Trim(host, "[]"), port),
+		Path:    path,
+	}, nil
+}
@@ -0,0 +1,32 @@
+package client_test
+
+import (
+	"github.com/craigfurman/ezxfer/client"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("parsing destinations", func() {
+	It("parses a host and port", func() {
+		Expect(client.ParseDestination("example.com:4545")).To(Equal(client.Destination{Address: "example.com:4545"}))
+	})
+
+	It("parses a remote path after the port", func() {
+		Expect(client.ParseDestination("example.com:4545:/incoming/build-42")).To(Equal(
+			client.Destination{Address: "example.com:4545", Path: "/incoming/build-42"},
+		))
+	})
+
+	It("parses IPv6 hosts", func() {
+		Expect(client.ParseDestination("[::1]:4545:incoming")).To(Equal(
+			client.Destination{Address: "[::1]:4545", Path: "incoming"},
+		))
+	})
+
+	It("requires a port", func() {
+		_, err := client.ParseDestination("example.com")
+		Expect(err).To(HaveOccurred())
+		_, err = client.ParseDestination("example.com::/incoming")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+func (c *Client) dial(address string) (net.Conn, error) {
+	if c.TLSFingerprint == "" {
+		return net.Dial("tcp", address)
+	}
+
+	expected := normaliseFingerprint(c.TLSFingerprint)
+	return tls.Dial("tcp", address, &tls.Config{
+		// The certificate is verified against the fingerprint instead of a CA.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if actual := hex.EncodeToString(sum[:]); actual != expected {
+				return fmt.Errorf("server certificate fingerprint %s does not match %s", actual, expected)
+			}
+			return nil
+		},
+	})
+}
+
+// normaliseFingerprint accepts fingerprints with an optional sha256: prefix,
+// colon separators and either case.
+func normaliseFingerprint(fingerprint string) string {
+	fingerprint = strings.ToLower(fingerprint)
+	fingerprint = strings.TrimPrefix(fingerprint, "sha256:")
+	return strings.Replace(fingerprint, ":", "", -1)
+}
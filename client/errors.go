@@ -0,0 +1,73 @@
+package client
+
+import (
+	"time"
+
+	"github.com/craigfurman/ezxfer/protocol"
+)
+
+// ServerError is an error reported by the server. Its Code classifies it,
+// and errors.Is matches it against the Err values with the same code.
+type ServerError struct {
+	Code    protocol.ErrorCode
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+func (e *ServerError) Is(target error) bool {
+	t, ok := target.(*ServerError)
+	return ok && t.Code == e.Code
+}
+
+// Errors that servers report, for use with errors.Is.
+var (
+	ErrUnauthorized     = &ServerError{Code: protocol.CodeUnauthorized, Message: "unauthorized"}
+	ErrPermissionDenied = &ServerError{Code: protocol.CodePermissionDenied, Message: "permission denied"}
+	ErrInvalidPath      = &ServerError{Code: protocol.CodeInvalidPath, Message: "invalid path"}
+	ErrInvalidRequest   = &ServerError{Code: protocol.CodeInvalidRequest, Message: "invalid request"}
+	ErrNotFound         = &ServerError{Code: protocol.CodeNotFound, Message: "not found"}
+	ErrConflict         = &ServerError{Code: protocol.CodeConflict, Message: "already exists"}
+	ErrChecksumMismatch = &ServerError{Code: protocol.CodeChecksum, Message: "checksum mismatch"}
+	ErrNoSpace          = &ServerError{Code: protocol.CodeNoSpace, Message: "no space"}
+	ErrQuotaExceeded    = &ServerError{Code: protocol.CodeQuotaExceeded, Message: "quota exceeded"}
+	ErrBusy             = &ServerError{Code: protocol.CodeBusy, Message: "server busy"}
+	ErrInternal         = &ServerError{Code: protocol.CodeInternal, Message: "internal server error"}
+)
+
+// BusyError is returned when the server is too busy to accept a request. It
+// matches ErrBusy.
+type BusyError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return e.Message
+}
+
+func (e *BusyError) Is(target error) bool {
+	return target == ErrBusy
+}
+
+// defaultRetryAfter is how long to wait before retrying busy servers that do
+// not say.
+const defaultRetryAfter = time.Second
+
+// serverError returns the error for a message and code sent by the server.
+// Servers that do not send codes have their errors classed as internal.
+func serverError(msg string, code protocol.ErrorCode, retryAfter int) error {
+	if code == protocol.CodeBusy || retryAfter > 0 {
+		busy := &BusyError{Message: msg, RetryAfter: time.Duration(retryAfter) * time.Second}
+		if busy.RetryAfter <= 0 {
+			busy.RetryAfter = defaultRetryAfter
+		}
+		return busy
+	}
+	if code == "" {
+		code = protocol.CodeInternal
+	}
+	return &ServerError{Code: code, Message: msg}
+}
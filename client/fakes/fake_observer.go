@@ -0,0 +1,64 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"sync"
+
+	"github.com/craigfurman/ezxfer/client"
+)
+
+type FakeObserver struct {
+	ObserveStub        func(event client.Event)
+	observeMutex       sync.RWMutex
+	observeArgsForCall []struct {
+		event client.Event
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeObserver) Observe(event client.Event) {
+	fake.observeMutex.Lock()
+	fake.observeArgsForCall = append(fake.observeArgsForCall, struct {
+		event client.Event
+	}{event})
+	fake.recordInvocation("Observe", []interface{}{event})
+	fake.observeMutex.Unlock()
+	if fake.ObserveStub != nil {
+		fake.ObserveStub(event)
+	}
+}
+
+func (fake *FakeObserver) ObserveCallCount() int {
+	fake.observeMutex.RLock()
+	defer fake.observeMutex.RUnlock()
+	return len(fake.observeArgsForCall)
+}
+
+func (fake *FakeObserver) ObserveArgsForCall(i int) client.Event {
+	fake.observeMutex.RLock()
+	defer fake.observeMutex.RUnlock()
+	return fake.observeArgsForCall[i].event
+}
+
+func (fake *FakeObserver) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	fake.observeMutex.RLock()
+	defer fake.observeMutex.RUnlock()
+	return fake.invocations
+}
+
+func (fake *FakeObserver) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ client.Observer = new(FakeObserver)
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/craigfurman/ezxfer/protocol"
+	"github.com/craigfurman/ezxfer/tarstream"
+)
+
+//go:generate counterfeiter -o fakes/fake_observer.go . Observer
+
+// Observer is told of each event of the transfers a Client makes. It is
+// called from every stream of a transfer at once, so must be safe for
+// concurrent use.
+type Observer interface {
+	Observe(event Event)
+}
+
+// Event is one of the event types below.
+type Event interface {
+	event()
+}
+
+// TransferStarted starts each send or get. Files and Size are 0 when they are
+// not known in advance, as for gets.
+type TransferStarted struct {
+	Op    string
+	Files int
+	Size  int64
+}
+
+// FileStarted is observed as a file starts to be sent or received. Files
+// striped over several streams are started once, with their whole size.
+type FileStarted struct {
+	Path string
+	Size int64
+}
+
+// BytesSent counts N more bytes of a file sent, or received.
+type BytesSent struct {
+	Path string
+	N    int64
+}
+
+// FileVerified is observed once a file has been saved and its checksum
+// verified, by the server for sends or by the client for gets.
+type FileVerified struct {
+	Path    string
+	Action  protocol.Action
+	SavedAs string
+}
+
+// FileFailed is observed when a file cannot be read, sent or saved.
+type FileFailed struct {
+	Path string
+	Err  error
+}
+
+// Retrying is observed before a request is retried because the server is
+// busy.
+type Retrying struct {
+	Attempt int
+	Delay   time.Duration
+	Err     error
+}
+
+// TransferDone ends each send or get, with the files verified, the bytes
+// sent or received, and any error.
+type TransferDone struct {
+	Files    int
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+func (TransferStarted) event() {}
+func (FileStarted) event()     {}
+func (BytesSent) event()       {}
+func (FileVerified) event()    {}
+func (FileFailed) event()      {}
+func (Retrying) event()        {}
+func (TransferDone) event()    {}
+
+func (c *Client) observe(event Event) {
+	if c.Observer != nil {
+		c.Observer.Observe(event)
+	}
+}
+
+// transfer observes a single send or get, and the files written to each of
+// its streams.
+type transfer struct {
+	client  *Client
+	started time.Time
+	bytes   int64
+	files   int
+	// striped transfers start their single file themselves, rather than
+	// once per stripe.
+	striped bool
+}
+
+func (c *Client) startTransfer(op string, files int, size int64) *transfer {
+	c.observe(TransferStarted{Op: op, Files: files, Size: size})
+	return &transfer{client: c, started: time.Now()}
+}
+
+func (t *transfer) FileStarted(name string, size int64) {
+	if !t.striped {
+		t.client.observe(FileStarted{Path: name, Size: size})
+	}
+}
+
+func (t *transfer) BytesWritten(name string, n int64) {
+	atomic.AddInt64(&t.bytes, n)
+	t.client.observe(BytesSent{Path: name, N: n})
+}
+
+func (t *transfer) FileFailed(name string, err error) {
+	t.client.observe(FileFailed{Path: name, Err: err})
+}
+
+// received returns a writer that counts the bytes of path received.
+func (t *transfer) received(path string) io.Writer {
+	return receivedWriter{transfer: t, path: path}
+}
+
+type receivedWriter struct {
+	transfer *transfer
+	path     string
+}
+
+func (w receivedWriter) Write(p []byte) (int, error) {
+	w.transfer.BytesWritten(w.path, int64(len(p)))
+	return len(p), nil
+}
+
+// verified observes a file saved.
+func (t *transfer) verified(file protocol.FileResult) {
+	t.files++
+	t.client.observe(FileVerified{Path: file.Path, Action: file.Action, SavedAs: file.SavedAs})
+}
+
+// done observes the files the server saved, then the end of the transfer, and
+// returns its outcome.
+func (t *transfer) done(result protocol.Result, err error) (protocol.Result, error) {
+	for _, file := range result.Files {
+		t.verified(file)
+	}
+	t.finish(err)
+	return result, err
+}
+
+func (t *transfer) finish(err error) {
+	t.client.observe(TransferDone{
+		Files:    t.files,
+		Bytes:    atomic.LoadInt64(&t.bytes),
+		Duration: time.Since(t.started),
+		Err:      err,
+	})
+}
+
+var _ tarstream.Observer = &transfer{}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/craigfurman/ezxfer/protocol"
+	"github.com/craigfurman/ezxfer/tarstream"
+)
+
+type fileToSend struct {
+	path string
+	size int64
+}
+
+// sendParallel sends the contents of dir over up to Streams connections at
+// once, as a single transfer.
+func (c *Client) sendParallel(t *transfer, dir string, dest Destination) (protocol.Result, error) {
+	files, err := filesIn(dir)
+	if err != nil {
+		return protocol.Result{}, err
+	}
+	streams := schedule(files, c.Streams)
+	id, err := newTransferID()
+	if err != nil {
+		return protocol.Result{}, err
+	}
+
+	return sendConcurrently(len(streams), func(i int) (protocol.Result, error) {
+		stream := streams[i]
+		var size int64
+		for _, file := range stream {
+			size += file.size
+		}
+		return c.sendStream(t, dest.Address, protocol.Request{
+			Op:             protocol.OpPut,
+			Path:           dest.Path,
+			ConflictPolicy: c.ConflictPolicy,
+			Size:           size,
+			TransferID:     id,
+			Streams:        len(streams),
+		}, func(tarStream *tarstream.Writer) error {
+			paths := make([]string, len(stream))
+			for i, file := range stream {
+				paths[i] = file.path
+			}
+			return tarStream.WritePaths(dir, paths)
+		})
+	})
+}
+
+// sendStriped sends a single file over Streams connections at once, each
+// carrying a byte range of it, as a single transfer.
+func (c *Client) sendStriped(t *transfer, filePath string, size int64, dest Destination) (protocol.Result, error) {
+	md5, err := tarstream.Checksum(filePath)
+	if err != nil {
+		return protocol.Result{}, err
+	}
+	stripes := stripe(size, c.Streams)
+	id, err := newTransferID()
+	if err != nil {
+		return protocol.Result{}, err
+	}
+
+	name := filepath.Base(filePath)
+	t.FileStarted(name, size)
+	t.striped = true
+	return sendConcurrently(len(stripes), func(i int) (protocol.Result, error) {
+		stripe := stripes[i]
+		return c.sendStream(t, dest.Address, protocol.Request{
+			Op:             protocol.OpPut,
+			Path:           dest.Path,
+			Rename:         dest.Rename,
+			ConflictPolicy: c.ConflictPolicy,
+			Size:           stripe.Length,
+			TransferID:     id,
+			Streams:        len(stripes),
+			Stripe:         &stripe,
+		}, func(tarStream *tarstream.Writer) error {
+			return tarStream.WriteRange(filePath, stripe.Offset, stripe.Length, md5)
+		})
+	})
+}
+
+// sendConcurrently runs send for each of n streams at once. The server
+// replies to every stream with the combined result, so the most complete one
+// is returned, with the first error.
+func sendConcurrently(n int, send func(i int) (protocol.Result, error)) (protocol.Result, error) {
+	type streamResult struct {
+		result protocol.Result
+		err    error
+	}
+	results := make(chan streamResult, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			result, err := send(i)
+			results <- streamResult{result: result, err: err}
+		}(i)
+	}
+
+	var combined streamResult
+	for i := 0; i < n; i++ {
+		r := <-results
+		if len(r.result.Files) > len(combined.result.Files) {
+			combined.result = r.result
+		}
+		if combined.err == nil {
+			combined.err = r.err
+		}
+	}
+	return combined.result, combined.err
+}
+
+// filesIn returns the files under dir.
+func filesIn(dir string) ([]fileToSend, error) {
+	var files []fileToSend
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, fileToSend{path: path, size: info.Size()})
+		}
+		return nil
+	})
+	return files, err
+}
+
+// schedule distributes files between at most n streams, largest first, each
+// to the stream with the fewest bytes so far. There is always at least one
+// stream, even with no files.
+func schedule(files []fileToSend, n int) [][]fileToSend {
+	sorted := append([]fileToSend(nil), files...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].size > sorted[j].size
+	})
+	if n > len(sorted) {
+		n = len(sorted)
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	streams := make([][]fileToSend, n)
+	sizes := make([]int64, n)
+	for _, file := range sorted {
+		smallest := 0
+		for i := range sizes {
+			if sizes[i] < sizes[smallest] {
+				smallest = i
+			}
+		}
+		streams[smallest] = append(streams[smallest], file)
+		sizes[smallest] += file.size
+	}
+	return streams
+}
+
+// stripe divides a file of size bytes into n ranges of about equal length.
+func stripe(size int64, n int) []protocol.Stripe {
+	length := (size + int64(n) - 1) / int64(n)
+	var stripes []protocol.Stripe
+	for offset := int64(0); offset < size; offset += length {
+		if offset+length > size {
+			length = size - offset
+		}
+		stripes = append(stripes, protocol.Stripe{Offset: offset, Length: length, FileSize: size})
+	}
+	return stripes
+}
+
+func newTransferID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
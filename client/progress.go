@@ -0,0 +1,93 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// Progress is an Observer that totals the progress of a whole transfer,
+// across every file and every stream it is sent over. Its totals are known in
+// advance for sends, and are otherwise 0.
+type Progress struct {
+	mu        sync.Mutex
+	files     int
+	size      int64
+	filesDone int
+	sent      int64
+	current   string
+	started   time.Time
+	// remaining is how many bytes are yet to be sent of each file started.
+	remaining map[string]int64
+}
+
+// ProgressSnapshot is the progress of a transfer at one moment.
+type ProgressSnapshot struct {
+	// Current is the file being sent most recently.
+	Current   string
+	FilesDone int
+	Files     int
+	Sent      int64
+	Size      int64
+	Elapsed   time.Duration
+	// Throughput is in bytes per second.
+	Throughput int64
+	// ETA is how much longer the transfer is expected to take, if its size
+	// is known.
+	ETA time.Duration
+}
+
+func (p *Progress) Observe(event Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch e := event.(type) {
+	case TransferStarted:
+		p.files, p.size = e.Files, e.Size
+		p.started = time.Now()
+		p.remaining = map[string]int64{}
+	case FileStarted:
+		p.current = e.Path
+		if e.Size == 0 {
+			p.filesDone++
+			return
+		}
+		if p.remaining == nil {
+			p.remaining = map[string]int64{}
+		}
+		p.remaining[e.Path] += e.Size
+	case BytesSent:
+		p.sent += e.N
+		// A file is done once all of its bytes are sent.
+		if remaining, ok := p.remaining[e.Path]; ok {
+			if remaining -= e.N; remaining > 0 {
+				p.remaining[e.Path] = remaining
+				return
+			}
+			delete(p.remaining, e.Path)
+			p.filesDone++
+		}
+	case FileFailed:
+		delete(p.remaining, e.Path)
+	}
+}
+
+func (p *Progress) Snapshot() ProgressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := ProgressSnapshot{
+		Current:   p.current,
+		FilesDone: p.filesDone,
+		Files:     p.files,
+		Sent:      p.sent,
+		Size:      p.size,
+	}
+	if !p.started.IsZero() {
+		s.Elapsed = time.Since(p.started)
+	}
+	if s.Elapsed > 0 {
+		s.Throughput = int64(float64(s.Sent) / s.Elapsed.Seconds())
+	}
+	if s.Throughput > 0 && s.Size > s.Sent {
+		s.ETA = time.Duration(float64(s.Size-s.Sent) / float64(s.Throughput) * float64(time.Second))
+	}
+	return s
+}
@@ -0,0 +1,64 @@
+package main
+
+import "flag"
+
+var rmCommand = &command{
+	name:    "rm",
+	args:    "<host:port:/remote/path>",
+	summary: "remove a file or directory on a server",
+	setup: func(flags *flag.FlagSet) func([]string) error {
+		recursive := flags.Bool("recursive", false, "remove directories that are not empty")
+		opts := addClientFlags(flags)
+
+		return func(args []string) error {
+			if err := expectArgs(args, 1, 1); err != nil {
+				return err
+			}
+			c, dest, err := opts.newClient(flags, args[0])
+			if err != nil {
+				return err
+			}
+			return c.Remove(dest, *recursive)
+		}
+	},
+}
+
+var mvCommand = &command{
+	name:    "mv",
+	args:    "<host:port:/remote/path> </new/remote/path>",
+	summary: "move a file or directory on a server",
+	setup: func(flags *flag.FlagSet) func([]string) error {
+		opts := addClientFlags(flags)
+
+		return func(args []string) error {
+			if err := expectArgs(args, 2, 2); err != nil {
+				return err
+			}
+			c, src, err := opts.newClient(flags, args[0])
+			if err != nil {
+				return err
+			}
+			return c.Move(src, args[1])
+		}
+	},
+}
+
+var mkdirCommand = &command{
+	name:    "mkdir",
+	args:    "<host:port:/remote/path>",
+	summary: "create a directory, and any missing parents, on a server",
+	setup: func(flags *flag.FlagSet) func([]string) error {
+		opts := addClientFlags(flags)
+
+		return func(args []string) error {
+			if err := expectArgs(args, 1, 1); err != nil {
+				return err
+			}
+			c, dest, err := opts.newClient(flags, args[0])
+			if err != nil {
+				return err
+			}
+			return c.Mkdir(dest)
+		}
+	},
+}
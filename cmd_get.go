@@ -0,0 +1,42 @@
+package main
+
+import "flag"
+
+var getCommand = &command{
+	name:    "get",
+	args:    "<host:port:/remote/path> [local directory]",
+	summary: "download a file or directory from a server, into the current directory by default",
+	setup: func(flags *flag.FlagSet) func([]string) error {
+		opts := addClientFlags(flags)
+		opts.addOutputFlag(flags)
+
+		return func(args []string) error {
+			if err := expectArgs(args, 1, 2); err != nil {
+				return err
+			}
+			c, src, err := opts.newClient(flags, args[0])
+			if err != nil {
+				return err
+			}
+			localDir := "."
+			if len(args) == 2 {
+				localDir = args[1]
+			}
+
+			logger := opts.logger()
+			logger.Printf("will download %s into %s...\n", args[0], localDir)
+			stopProgress := showProgress(c)
+			saved, err := c.Get(src, localDir)
+			stopProgress()
+			for _, path := range saved {
+				logger.Printf("saved %s\n", path)
+			}
+			if err != nil {
+				return err
+			}
+
+			logger.Println("done!")
+			return nil
+		}
+	},
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/craigfurman/ezxfer/client"
+	"github.com/craigfurman/ezxfer/protocol"
+)
+
+var lsCommand = &command{
+	name:    "ls",
+	args:    "<host:port[:/remote/path]>",
+	summary: "list files on a server",
+	setup: func(flags *flag.FlagSet) func([]string) error {
+		recursive := flags.Bool("recursive", false, "list the whole tree rather than a single level")
+		checksums := flags.Bool("checksums", false, "include MD5 checksums")
+		asJSON := flags.Bool("json", false, "print the listing as JSON")
+		opts := addClientFlags(flags)
+
+		return func(args []string) error {
+			if err := expectArgs(args, 1, 1); err != nil {
+				return err
+			}
+			c, src, err := opts.newClient(flags, args[0])
+			if err != nil {
+				return err
+			}
+
+			entries, err := c.List(src, client.ListOptions{Recursive: *recursive, Checksums: *checksums})
+			if err != nil {
+				return err
+			}
+			return printListing(entries, *asJSON, *checksums)
+		}
+	},
+}
+
+func printListing(entries []protocol.Entry, asJSON, checksums bool) error {
+	if asJSON {
+		type jsonEntry struct {
+			Path    string    `json:"path"`
+			Size    int64     `json:"size"`
+			Mode    string    `json:"mode"`
+			ModTime time.Time `json:"mod_time"`
+			IsDir   bool      `json:"is_dir"`
+			MD5     string    `json:"md5,omitempty"`
+		}
+		out := make([]jsonEntry, 0, len(entries))
+		for _, entry := range entries {
+			out = append(out, jsonEntry{
+				Path:    entry.Path,
+				Size:    entry.Size,
+				Mode:    entry.Mode.String(),
+				ModTime: entry.ModTime,
+				IsDir:   entry.Mode.IsDir(),
+				MD5:     entry.MD5,
+			})
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(out)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if checksums {
+		fmt.Fprintln(w, "MODE\tSIZE\tMODIFIED\tMD5\tPATH")
+	} else {
+		fmt.Fprintln(w, "MODE\tSIZE\tMODIFIED\tPATH")
+	}
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%d\t%s\t", entry.Mode, entry.Size, entry.ModTime.Local().Format(time.RFC3339))
+		if checksums {
+			fmt.Fprintf(w, "%s\t", entry.MD5)
+		}
+		fmt.Fprintln(w, entry.Path)
+	}
+	return w.Flush()
+}
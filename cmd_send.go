@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/craigfurman/ezxfer/protocol"
+	"github.com/craigfurman/ezxfer/tarstream"
+	"github.com/craigfurman/ezxfer/units"
+)
+
+var sendCommand = &command{
+	name:    "send",
+	args:    "<file or directory> <host:port[:/remote/path]>",
+	summary: "send a file, or a directory's contents, to a server",
+	setup: func(flags *flag.FlagSet) func([]string) error {
+		rename := flags.String("rename", "", "name to save a single file under on the server")
+		onConflict := flags.String("onConflict", "", "what the server should do with files that already exist: fail, skip, rename, overwrite-if-newer or overwrite")
+		streams := flags.Int("streams", 1, "number of connections to send a directory's files, or a large file, over at once")
+		stripeThreshold := flags.String("stripeThreshold", "64MiB", "size from which a single file is split between -streams connections")
+		hashers := flags.Int("hashers", tarstream.DefaultHashers, "number of files to read and checksum ahead of the one being sent")
+		bufferSize := flags.String("bufferSize", "1MiB", "size of the buffers files are read with")
+		batchBelow := flags.String("batchBelow", "64KiB", "size below which a directory's files are sent in batches, or 0 to send each on its own")
+		opts := addClientFlags(flags)
+		opts.addOutputFlag(flags)
+
+		return func(args []string) error {
+			if err := expectArgs(args, 2, 2); err != nil {
+				return err
+			}
+			c, dest, err := opts.newClient(flags, args[1])
+			if err != nil {
+				return err
+			}
+			dest.Rename = *rename
+			c.Streams = *streams
+			if c.StripeThreshold, err = units.ParseBytes(*stripeThreshold); err != nil {
+				return usageError(err.Error())
+			}
+			c.Hashers = *hashers
+			size, err := units.ParseBytes(*bufferSize)
+			if err != nil {
+				return usageError(err.Error())
+			}
+			c.BufferSize = int(size)
+			if c.SmallFileSize, err = units.ParseBytes(*batchBelow); err != nil {
+				return usageError(err.Error())
+			}
+
+			if *onConflict != "" {
+				if c.ConflictPolicy, err = protocol.ParseConflictPolicy(*onConflict); err != nil {
+					return usageError(err.Error())
+				}
+			}
+
+			logger := opts.logger()
+			logger.Printf("will transfer file %s to %s...\n", args[0], args[1])
+			stopProgress := showProgress(c)
+			result, err := c.Send(args[0], dest)
+			stopProgress()
+			for _, file := range result.Files {
+				if file.SavedAs != "" {
+					logger.Printf("%s: %s as %s\n", file.Path, file.Action, file.SavedAs)
+				} else {
+					logger.Printf("%s: %s\n", file.Path, file.Action)
+				}
+			}
+			if err != nil {
+				return err
+			}
+
+			logger.Println("done!")
+			return nil
+		}
+	},
+}
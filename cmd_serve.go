@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/craigfurman/ezxfer/config"
+	"github.com/craigfurman/ezxfer/protocol"
+	"github.com/craigfurman/ezxfer/ratelimit"
+	"github.com/craigfurman/ezxfer/server"
+	"github.com/craigfurman/ezxfer/units"
+	"github.com/craigfurman/ezxfer/versions"
+)
+
+var serveCommand = &command{
+	name:    "serve",
+	summary: "receive files from, and serve files to, clients",
+	setup: func(flags *flag.FlagSet) func([]string) error {
+		cfg := config.DefaultServer()
+		configPath := flags.String("config", "", "path to a YAML server profile")
+		port := flags.Int("port", 0, "port to listen on, instead of -listen")
+		flags.Var((*stringList)(&cfg.Listen), "listen", "comma separated addresses to listen on")
+		flags.StringVar(&cfg.Root, "root", cfg.Root, "directory to serve")
+		flags.Var((*stringList)(&cfg.Auth.Tokens), "tokens", "comma separated tokens that clients must present one of")
+		flags.StringVar(&cfg.Auth.TLSCert, "tlsCert", "", "PEM certificate to serve TLS with")
+		flags.StringVar(&cfg.Auth.TLSKey, "tlsKey", "", "PEM private key to serve TLS with")
+		flags.BoolVar(&cfg.Permissions.Read, "allowRead", cfg.Permissions.Read, "allow clients to download and list files")
+		flags.BoolVar(&cfg.Permissions.Write, "allowWrite", cfg.Permissions.Write, "allow clients to send files")
+		flags.BoolVar(&cfg.Permissions.Delete, "allowDelete", cfg.Permissions.Delete, "allow clients to remove files and directories")
+		flags.BoolVar(&cfg.Permissions.Move, "allowMove", cfg.Permissions.Move, "allow clients to move files and directories")
+		flags.BoolVar(&cfg.Permissions.Mkdir, "allowMkdir", cfg.Permissions.Mkdir, "allow clients to create directories")
+		flags.StringVar(&cfg.ConflictPolicy, "conflictPolicy", cfg.ConflictPolicy, "policy for existing files when the client does not ask for one")
+		flags.StringVar(&cfg.Limits.MaxConflictPolicy, "maxConflictPolicy", cfg.Limits.MaxConflictPolicy, "most destructive conflict policy clients may ask for")
+		flags.StringVar(&cfg.Durability, "durability", cfg.Durability, "when to sync received files to disk: none, file (each file before moving on) or batch (all files before replying)")
+		flags.BoolVar(&cfg.Versions.Enabled, "backupVersions", cfg.Versions.Enabled, "keep previous versions of overwritten files in "+versions.DirName)
+		flags.IntVar(&cfg.Limits.MaxVersions, "maxVersions", cfg.Limits.MaxVersions, "number of versions to keep per file, 0 for no limit")
+		flags.DurationVar(&cfg.Limits.MaxVersionAge, "maxVersionAge", cfg.Limits.MaxVersionAge, "how long to keep versions for, 0 for no limit")
+		flags.IntVar(&cfg.Limits.MaxTransfers, "maxTransfers", cfg.Limits.MaxTransfers, "number of transfers to serve at once, 0 for no limit")
+		flags.IntVar(&cfg.Limits.MaxTransfersPerIP, "maxTransfersPerIP", cfg.Limits.MaxTransfersPerIP, "number of transfers to serve at once per client IP, 0 for no limit")
+		flags.BoolVar(&cfg.Limits.QueueWhenBusy, "queueWhenBusy", cfg.Limits.QueueWhenBusy, "queue transfers over the limits instead of refusing them")
+		flags.DurationVar(&cfg.Limits.RetryAfter, "retryAfter", cfg.Limits.RetryAfter, "how long refused clients are asked to wait before retrying")
+		flags.StringVar(&cfg.Limits.Bandwidth, "limit", cfg.Limits.Bandwidth, "bandwidth limit for all transfers together, e.g. 20MB/s")
+		flags.StringVar(&cfg.Limits.ConnectionBandwidth, "connectionLimit", cfg.Limits.ConnectionBandwidth, "bandwidth limit for each transfer, e.g. 5MB/s")
+		flags.DurationVar(&cfg.Limits.ShutdownGracePeriod, "shutdownGracePeriod", cfg.Limits.ShutdownGracePeriod, "how long in-flight transfers may take to finish on SIGINT or SIGTERM")
+
+		return func(args []string) error {
+			if err := expectArgs(args, 0, 0); err != nil {
+				return err
+			}
+			if err := loadConfig(flags, func() error { return config.LoadServer(*configPath, &cfg) }); err != nil {
+				return err
+			}
+			if *port != 0 {
+				cfg.Listen = []string{fmt.Sprintf(":%d", *port)}
+			}
+			if len(cfg.Listen) == 0 {
+				return usageError("-port or -listen is required")
+			}
+
+			srv, err := newServer(cfg)
+			if err != nil {
+				return err
+			}
+			watchLimitSignals(srv.Logger, srv.Limiter, srv.ConnectionLimiter)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(signals)
+			go func() {
+				select {
+				case sig := <-signals:
+					srv.Logger.Printf("received %s, waiting up to %s for transfers to finish", sig, srv.ShutdownGracePeriod)
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+
+			var listeners []net.Listener
+			for _, address := range cfg.Listen {
+				listener, err := net.Listen("tcp", address)
+				if err != nil {
+					for _, listener := range listeners {
+						listener.Close()
+					}
+					return err
+				}
+				listeners = append(listeners, listener)
+			}
+
+			errs := make(chan error, len(listeners))
+			for _, listener := range listeners {
+				go func(listener net.Listener) {
+					errs <- srv.Serve(ctx, listener)
+				}(listener)
+			}
+			err = <-errs
+			cancel()
+			for range listeners[1:] {
+				<-errs
+			}
+			if err == context.Canceled {
+				srv.Logger.Println("stopped")
+				return nil
+			}
+			return err
+		}
+	},
+}
+
+func newServer(cfg config.Server) (*server.Server, error) {
+	defaultPolicy, err := protocol.ParseConflictPolicy(cfg.ConflictPolicy)
+	if err != nil {
+		return nil, usageError(err.Error())
+	}
+	maxPolicy, err := protocol.ParseConflictPolicy(cfg.Limits.MaxConflictPolicy)
+	if err != nil {
+		return nil, usageError(err.Error())
+	}
+	durability, err := server.ParseDurability(cfg.Durability)
+	if err != nil {
+		return nil, usageError(err.Error())
+	}
+	limit, err := ratelimit.ParseRate(cfg.Limits.Bandwidth)
+	if err != nil {
+		return nil, usageError(err.Error())
+	}
+	connectionLimit, err := ratelimit.ParseRate(cfg.Limits.ConnectionBandwidth)
+	if err != nil {
+		return nil, usageError(err.Error())
+	}
+	clientQuotas, err := parseQuotas(cfg.Quotas.Clients)
+	if err != nil {
+		return nil, err
+	}
+	dirQuotas, err := parseQuotas(cfg.Quotas.Dirs)
+	if err != nil {
+		return nil, err
+	}
+	destDir, err := absDir(cfg.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &server.Server{
+		DestDir: destDir,
+		Logger:  createLogger("[ezxfer server] "),
+		Permissions: server.Permissions{
+			Read:   cfg.Permissions.Read,
+			Write:  cfg.Permissions.Write,
+			Delete: cfg.Permissions.Delete,
+			Move:   cfg.Permissions.Move,
+			Mkdir:  cfg.Permissions.Mkdir,
+		},
+		ConflictPolicy:      defaultPolicy,
+		MaxConflictPolicy:   maxPolicy,
+		Tokens:              cfg.Auth.Tokens,
+		ShutdownGracePeriod: cfg.Limits.ShutdownGracePeriod,
+		MaxTransfers:        cfg.Limits.MaxTransfers,
+		MaxTransfersPerIP:   cfg.Limits.MaxTransfersPerIP,
+		QueueWhenBusy:       cfg.Limits.QueueWhenBusy,
+		RetryAfter:          cfg.Limits.RetryAfter,
+		Limiter:             ratelimit.NewLimiter(limit),
+		ConnectionLimiter:   ratelimit.NewLimiter(connectionLimit),
+		Quotas:              server.Quotas{Clients: clientQuotas, Dirs: dirQuotas},
+		Durability:          durability,
+	}
+	if cfg.Versions.Enabled {
+		srv.Versions = &versions.Store{Root: destDir, MaxCount: cfg.Limits.MaxVersions, MaxAge: cfg.Limits.MaxVersionAge}
+	}
+
+	if cfg.Auth.TLSCert != "" || cfg.Auth.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Auth.TLSCert, cfg.Auth.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		srv.Logger.Printf("serving TLS with certificate fingerprint sha256:%x", sha256.Sum256(cert.Certificate[0]))
+	}
+	return srv, nil
+}
+
+func parseQuotas(quotas map[string]string) (map[string]int64, error) {
+	parsed := map[string]int64{}
+	for key, quota := range quotas {
+		size, err := units.ParseBytes(quota)
+		if err != nil {
+			return nil, usageError(err.Error())
+		}
+		parsed[key] = size
+	}
+	return parsed, nil
+}
+
+// absDir returns the absolute path of a directory that must exist.
+func absDir(dir string) (string, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return filepath.Abs(dir)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+var versionCommand = &command{
+	name:    "version",
+	summary: "print ezxfer's version",
+	setup: func(flags *flag.FlagSet) func([]string) error {
+		return func(args []string) error {
+			if err := expectArgs(args, 0, 0); err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stdout, version)
+			return nil
+		}
+	},
+}
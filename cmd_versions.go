@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/craigfurman/ezxfer/versions"
+)
+
+var versionsCommand = &command{
+	name:    "versions",
+	args:    "<path>",
+	summary: "list, or restore, the versions a server kept of a path under its root",
+	setup: func(flags *flag.FlagSet) func([]string) error {
+		root := flags.String("root", ".", "the server's root directory")
+		restore := flags.String("restore", "", "version to restore the path to")
+
+		return func(args []string) error {
+			if err := expectArgs(args, 1, 1); err != nil {
+				return err
+			}
+			rootDir, err := absDir(*root)
+			if err != nil {
+				return err
+			}
+			store := &versions.Store{Root: rootDir}
+
+			if *restore != "" {
+				return store.Restore(args[0], *restore)
+			}
+
+			found, err := store.List(args[0])
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "VERSION\tSAVED\tSIZE")
+			for _, version := range found {
+				fmt.Fprintf(w, "%s\t%s\t%d\n", version.ID, version.Time.Local().Format(time.RFC3339), version.Size)
+			}
+			return w.Flush()
+		}
+	},
+}
@@ -0,0 +1,150 @@
+// Package config loads ezxfer's YAML configuration files: named remotes for
+// clients, and profiles for servers.
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Client is the configuration read from the client's config file.
+type Client struct {
+	Remotes map[string]Remote `yaml:"remotes"`
+}
+
+// Remote is a named server that clients can use in place of host:port.
+type Remote struct {
+	Host  string `yaml:"host"`
+	Port  int    `yaml:"port"`
+	Token string `yaml:"token"`
+	// TLSFingerprint is the SHA-256 fingerprint of the server's certificate.
+	// Connections to the remote use TLS when it is set.
+	TLSFingerprint string `yaml:"tls_fingerprint"`
+	// RemoteDir is used when a destination names the remote without a path.
+	RemoteDir string `yaml:"remote_dir"`
+}
+
+// Server is a server profile.
+type Server struct {
+	Root           string      `yaml:"root"`
+	Listen         []string    `yaml:"listen"`
+	Auth           Auth        `yaml:"auth"`
+	Permissions    Permissions `yaml:"permissions"`
+	ConflictPolicy string      `yaml:"conflict_policy"`
+	Versions       Versions    `yaml:"versions"`
+	Limits         Limits      `yaml:"limits"`
+	Quotas         Quotas      `yaml:"quotas"`
+	// Durability is when received files are synced to disk: none, file or
+	// batch.
+	Durability string `yaml:"durability"`
+}
+
+type Auth struct {
+	// Tokens, if any are set, are the tokens clients must present.
+	Tokens []string `yaml:"tokens"`
+	// TLSCert and TLSKey, if set, are PEM files used to serve TLS.
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+}
+
+type Permissions struct {
+	Read   bool `yaml:"read"`
+	Write  bool `yaml:"write"`
+	Delete bool `yaml:"delete"`
+	Move   bool `yaml:"move"`
+	Mkdir  bool `yaml:"mkdir"`
+}
+
+type Versions struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+type Limits struct {
+	MaxConflictPolicy string        `yaml:"max_conflict_policy"`
+	MaxVersions       int           `yaml:"max_versions"`
+	MaxVersionAge     time.Duration `yaml:"max_version_age"`
+	// ShutdownGracePeriod is how long in-flight transfers may take to finish
+	// when the server is stopped.
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+
+	MaxTransfers      int  `yaml:"max_transfers"`
+	MaxTransfersPerIP int  `yaml:"max_transfers_per_ip"`
+	QueueWhenBusy     bool `yaml:"queue_when_busy"`
+	// RetryAfter is how long clients refused for being over the limits are
+	// asked to wait.
+	RetryAfter time.Duration `yaml:"retry_after"`
+
+	// Bandwidth and ConnectionBandwidth limit all transfers together and
+	// each transfer, as rates such as 20MB/s.
+	Bandwidth           string `yaml:"bandwidth"`
+	ConnectionBandwidth string `yaml:"connection_bandwidth"`
+}
+
+// Quotas are sizes such as 10GB, keyed by client token (or IP address, when
+// the server does not require tokens) and by directory under the root.
+type Quotas struct {
+	Clients map[string]string `yaml:"clients"`
+	Dirs    map[string]string `yaml:"dirs"`
+}
+
+// DefaultServer returns the profile used for anything a server's config file
+// does not set.
+func DefaultServer() Server {
+	return Server{
+		Root:           ".",
+		Permissions:    Permissions{Write: true},
+		ConflictPolicy: "overwrite",
+		Durability:     "none",
+		Limits: Limits{
+			MaxConflictPolicy:   "overwrite",
+			ShutdownGracePeriod: 30 * time.Second,
+			RetryAfter:          5 * time.Second,
+		},
+	}
+}
+
+// ClientPath returns the default location of the client's config file,
+// $XDG_CONFIG_HOME/ezxfer/config.yaml or ~/.config/ezxfer/config.yaml.
+func ClientPath() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "ezxfer", "config.yaml")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "ezxfer", "config.yaml")
+}
+
+// LoadClient reads the client config at path. A missing file is not an
+// error, and results in an empty config.
+func LoadClient(path string) (Client, error) {
+	var cfg Client
+	if err := load(path, &cfg, true); err != nil {
+		return Client{}, err
+	}
+	return cfg, nil
+}
+
+// LoadServer reads the server profile at path over the values already in cfg.
+func LoadServer(path string, cfg *Server) error {
+	return load(path, cfg, false)
+}
+
+func load(path string, cfg interface{}, optional bool) error {
+	if path == "" {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && optional {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(contents, cfg)
+}
@@ -0,0 +1,95 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/craigfurman/ezxfer/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("config files", func() {
+	var tempDir string
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "ezxfer-config-tests")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tempDir)).To(Succeed())
+	})
+
+	writeConfig := func(contents string) string {
+		path := filepath.Join(tempDir, "config.yaml")
+		Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+		return path
+	}
+
+	Describe("LoadClient", func() {
+		It("reads named remotes", func() {
+			cfg, err := config.LoadClient(writeConfig(`
+remotes:
+  nas:
+    host: nas.local
+    port: 4545
+    token: secret
+    tls_fingerprint: "sha256:ab:cd"
+    remote_dir: /incoming
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Remotes).To(Equal(map[string]config.Remote{
+				"nas": {Host: "nas.local", Port: 4545, Token: "secret", TLSFingerprint: "sha256:ab:cd", RemoteDir: "/incoming"},
+			}))
+		})
+
+		It("returns an empty config when the file does not exist", func() {
+			cfg, err := config.LoadClient(filepath.Join(tempDir, "missing.yaml"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Remotes).To(BeEmpty())
+		})
+
+		It("returns an error for invalid YAML", func() {
+			_, err := config.LoadClient(writeConfig("remotes: ["))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("LoadServer", func() {
+		It("overlays the profile on the values already set", func() {
+			cfg := config.DefaultServer()
+			Expect(config.LoadServer(writeConfig(`
+root: /srv/drop
+listen: [":4545", "127.0.0.1:4546"]
+auth:
+  tokens: [secret]
+permissions:
+  read: true
+limits:
+  max_versions: 3
+  max_version_age: 24h
+quotas:
+  dirs:
+    incoming: 10GB
+`), &cfg)).To(Succeed())
+
+			Expect(cfg.Root).To(Equal("/srv/drop"))
+			Expect(cfg.Listen).To(Equal([]string{":4545", "127.0.0.1:4546"}))
+			Expect(cfg.Auth.Tokens).To(Equal([]string{"secret"}))
+			Expect(cfg.Permissions).To(Equal(config.Permissions{Read: true, Write: true}))
+			Expect(cfg.ConflictPolicy).To(Equal("overwrite"))
+			Expect(cfg.Limits.MaxVersions).To(Equal(3))
+			Expect(cfg.Limits.MaxVersionAge).To(Equal(24 * time.Hour))
+			Expect(cfg.Quotas.Dirs).To(Equal(map[string]string{"incoming": "10GB"}))
+		})
+
+		It("returns an error when the file does not exist", func() {
+			cfg := config.DefaultServer()
+			Expect(config.LoadServer(filepath.Join(tempDir, "missing.yaml"), &cfg)).NotTo(Succeed())
+		})
+	})
+})
@@ -0,0 +1,104 @@
+package integrationtests
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/craigfurman/ezxfer/testhelpers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("the command line interface", func() {
+	runEzxfer := func(args ...string) *gexec.Session {
+		session, err := gexec.Start(exec.Command(binPath, args...), GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit())
+		return session
+	}
+
+	It("prints usage and exits 2 when no command is given", func() {
+		session := runEzxfer()
+		Expect(session.ExitCode()).To(Equal(2))
+		Expect(session.Err).To(gbytes.Say("usage: ezxfer <command>"))
+		Expect(session.Err).To(gbytes.Say("serve"))
+	})
+
+	It("exits 2 for unknown commands", func() {
+		session := runEzxfer("explode")
+		Expect(session.ExitCode()).To(Equal(2))
+		Expect(session.Err).To(gbytes.Say(`unknown command "explode"`))
+	})
+
+	It("prints per-command help", func() {
+		session := runEzxfer("send", "-h")
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(session.Err).To(gbytes.Say(`usage: ezxfer send \[flags\] <file or directory> <host:port\[:/remote/path\]>`))
+		Expect(session.Err).To(gbytes.Say("-onConflict"))
+	})
+
+	It("prints its version", func() {
+		session := runEzxfer("version")
+		Expect(session.ExitCode()).To(Equal(0))
+		Expect(session.Out).To(gbytes.Say("dev"))
+	})
+
+	It("exits 2 when required arguments are missing", func() {
+		session := runEzxfer("send", "a-file")
+		Expect(session.ExitCode()).To(Equal(2))
+		Expect(session.Err).To(gbytes.Say("not enough arguments"))
+	})
+
+	It("exits 2 when a required flag is missing", func() {
+		session := runEzxfer("serve")
+		Expect(session.ExitCode()).To(Equal(2))
+		Expect(session.Err).To(gbytes.Say("-port or -listen is required"))
+	})
+
+	It("exits 2 for malformed destinations", func() {
+		session := runEzxfer("ls", "localhost")
+		Expect(session.ExitCode()).To(Equal(2))
+		Expect(session.Err).To(gbytes.Say("missing port|expected host:port"))
+	})
+
+	It("exits 3 when it cannot connect to the server", func() {
+		session := runEzxfer("ls", "localhost:1")
+		Expect(session.ExitCode()).To(Equal(3))
+	})
+
+	It("exits 4 when a local file cannot be read", func() {
+		session := runEzxfer("send", "/does/not/exist", "localhost:1")
+		Expect(session.ExitCode()).To(Equal(4))
+	})
+
+	Describe("versions", func() {
+		var root string
+
+		BeforeEach(func() {
+			var err error
+			root, err = ioutil.TempDir("", "ezxfer-tests")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(testhelpers.CreateFile("old", root, ".ezxfer-versions", "a.txt", "20260101T000000.000000000Z")).To(Succeed())
+			Expect(testhelpers.CreateFile("new", root, "a.txt")).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(root)).To(Succeed())
+		})
+
+		It("lists and restores kept versions", func() {
+			session := runEzxfer("versions", "-root", root, "a.txt")
+			Expect(session.ExitCode()).To(Equal(0))
+			Expect(session.Out).To(gbytes.Say(`20260101T000000.000000000Z\s+\S+\s+3`))
+
+			session = runEzxfer("versions", "-root", root, "-restore", "20260101T000000.000000000Z", "a.txt")
+			Expect(session.ExitCode()).To(Equal(0))
+			Expect(readFile(root, "a.txt")).To(Equal("old"))
+			Expect(filepath.Join(root, ".ezxfer-versions", "a.txt")).To(BeADirectory())
+		})
+	})
+})
@@ -2,16 +2,19 @@ package integrationtests
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/craigfurman/ezxfer/testhelpers"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 )
 
@@ -31,6 +34,8 @@ var _ = Describe("transferring files", func() {
 		serverProcess *gexec.Session
 		sourceFiles   string
 		clientStdout  *bytes.Buffer
+		sendFlags     []string
+		dest          string
 	)
 
 	BeforeEach(func() {
@@ -39,15 +44,17 @@ var _ = Describe("transferring files", func() {
 		Expect(err).NotTo(HaveOccurred())
 		destDir = filepath.Join(tempDir, "dest")
 		Expect(os.MkdirAll(destDir, 0755)).To(Succeed())
-		serverCmd := exec.Command(binPath, fmt.Sprintf("-serveOnPort=%d", serverPort))
+		serverCmd := exec.Command(binPath, "serve", fmt.Sprintf("-port=%d", serverPort), "-allowRead")
 		serverCmd.Dir = destDir
 		serverProcess, err = gexec.Start(serverCmd, GinkgoWriter, GinkgoWriter)
 		Expect(err).NotTo(HaveOccurred())
 		Eventually(testhelpers.IsListening(fmt.Sprintf("localhost:%d", serverPort))).Should(BeTrue())
+		sendFlags = nil
+		dest = fmt.Sprintf("localhost:%d", serverPort)
 	})
 
 	JustBeforeEach(func() {
-		clientCmd := exec.Command(binPath, "-file", sourceFiles, "-dstHost", "localhost", fmt.Sprintf("-dstPort=%d", serverPort))
+		clientCmd := exec.Command(binPath, append(append([]string{"send"}, sendFlags...), sourceFiles, dest)...)
 		clientStdout = new(bytes.Buffer)
 		clientProcess, err := gexec.Start(clientCmd, io.MultiWriter(clientStdout, GinkgoWriter), GinkgoWriter)
 		Expect(err).NotTo(HaveOccurred())
@@ -76,8 +83,106 @@ var _ = Describe("transferring files", func() {
 			Expect(string(actualContent)).To(Equal(fileContent))
 		})
 
-		It("shows a progress bar", func() {
+		It("shows a progress bar for the whole transfer", func() {
 			Expect(clientStdout.String()).To(ContainSubstring("100.00%"))
+			Expect(clientStdout.String()).To(ContainSubstring("1/1 files"))
+		})
+
+		Context("when asked not to show progress", func() {
+			BeforeEach(func() {
+				sendFlags = []string{"-progress", "none"}
+			})
+
+			It("shows no progress bar", func() {
+				Expect(clientStdout.String()).NotTo(ContainSubstring("%"))
+			})
+		})
+
+		Context("when asked for JSON output", func() {
+			BeforeEach(func() {
+				sendFlags = []string{"-output", "json"}
+			})
+
+			It("writes only a JSON event per line, ending with a summary", func() {
+				Expect(clientStdout.String()).NotTo(ContainSubstring("\x1b"))
+				lines := strings.Split(strings.TrimSpace(clientStdout.String()), "\n")
+				var events []string
+				var summary map[string]interface{}
+				for _, line := range lines {
+					var event map[string]interface{}
+					Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+					Expect(event["time"]).NotTo(BeEmpty())
+					events = append(events, event["event"].(string))
+					if event["event"] == "bytes_sent" {
+						Expect(event).To(HaveKeyWithValue("bytes", float64(len(fileContent))))
+					}
+					summary = event
+				}
+				Expect(events).To(Equal([]string{"transfer_started", "file_started", "bytes_sent", "file_verified", "summary"}))
+
+				Expect(summary).To(HaveKeyWithValue("op", "put"))
+				Expect(summary).To(HaveKeyWithValue("ok", true))
+				Expect(summary).To(HaveKeyWithValue("files", float64(1)))
+				Expect(summary).To(HaveKeyWithValue("bytes", float64(len(fileContent))))
+				Expect(summary).To(HaveKey("duration_seconds"))
+				Expect(summary).To(HaveKey("bytes_per_second"))
+				Expect(summary["file_statuses"]).To(Equal([]interface{}{
+					map[string]interface{}{"path": fileName, "status": "verified", "action": "created"},
+				}))
+			})
+		})
+
+		Context("when a remote path and new name are given", func() {
+			BeforeEach(func() {
+				dest = fmt.Sprintf("localhost:%d:/incoming/build-42", serverPort)
+				sendFlags = []string{"-rename", "renamed.txt"}
+			})
+
+			It("transfers the file to the remote path under the new name", func() {
+				Expect(readFile(destDir, "incoming", "build-42", "renamed.txt")).To(Equal(fileContent))
+			})
+		})
+
+		Context("when split between several streams", func() {
+			BeforeEach(func() {
+				sendFlags = []string{"-streams", "3", "-stripeThreshold", "1"}
+			})
+
+			It("transfers the file", func() {
+				Expect(readFile(destDir, fileName)).To(Equal(fileContent))
+			})
+		})
+
+		Context("when the destination is a remote named in the client config file", func() {
+			BeforeEach(func() {
+				configPath := filepath.Join(tempDir, "config.yaml")
+				Expect(ioutil.WriteFile(configPath, []byte(fmt.Sprintf(`
+remotes:
+  local:
+    host: localhost
+    port: %d
+    remote_dir: /from-config
+`, serverPort)), 0600)).To(Succeed())
+				sendFlags = []string{"-config", configPath}
+				dest = "local"
+			})
+
+			It("transfers the file to the remote's directory", func() {
+				Expect(readFile(destDir, "from-config", fileName)).To(Equal(fileContent))
+			})
+		})
+
+		Context("when the file already exists on the server and the client asks for it to be renamed", func() {
+			BeforeEach(func() {
+				Expect(testhelpers.CreateFile("existing content", destDir, fileName)).To(Succeed())
+				sendFlags = []string{"-onConflict", "rename"}
+			})
+
+			It("keeps both files and reports what it did", func() {
+				Expect(readFile(destDir, fileName)).To(Equal("existing content"))
+				Expect(readFile(destDir, "to_copy.1.txt")).To(Equal(fileContent))
+				Expect(clientStdout.String()).To(ContainSubstring("to_copy.txt: renamed as to_copy.1.txt"))
+			})
 		})
 	})
 
@@ -94,5 +199,60 @@ var _ = Describe("transferring files", func() {
 			Expect(readFile(destDir, "d1", "b.txt")).To(Equal("content for b.txt"))
 			Expect(readFile(destDir, "d1", "d2", "c.txt")).To(Equal("content for c.txt"))
 		})
+
+		Context("when sent over several streams", func() {
+			BeforeEach(func() {
+				sendFlags = []string{"-streams", "3"}
+			})
+
+			It("transfers the directory", func() {
+				Expect(readFile(destDir, "a.txt")).To(Equal("content for a.txt"))
+				Expect(readFile(destDir, "d1", "b.txt")).To(Equal("content for b.txt"))
+				Expect(readFile(destDir, "d1", "d2", "c.txt")).To(Equal("content for c.txt"))
+			})
+		})
+
+		It("can download the directory again", func() {
+			downloadDir := filepath.Join(tempDir, "download")
+			getCmd := exec.Command(binPath, "get", fmt.Sprintf("localhost:%d:/d1", serverPort), downloadDir)
+			getProcess, err := gexec.Start(getCmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(getProcess).Should(gexec.Exit(0))
+
+			Expect(readFile(downloadDir, "b.txt")).To(Equal("content for b.txt"))
+			Expect(readFile(downloadDir, "d2", "c.txt")).To(Equal("content for c.txt"))
+		})
+
+		It("cannot remove files unless the server allows it", func() {
+			rmCmd := exec.Command(binPath, "rm", "-recursive", fmt.Sprintf("localhost:%d:/d1", serverPort))
+			rmProcess, err := gexec.Start(rmCmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(rmProcess).Should(gexec.Exit(5))
+			Expect(rmProcess.Err).To(gbytes.Say("rm is not allowed"))
+			Expect(filepath.Join(destDir, "d1")).To(BeADirectory())
+		})
+
+		It("stops the server cleanly on SIGTERM", func() {
+			serverProcess.Terminate()
+			Eventually(serverProcess).Should(gexec.Exit(0))
+			Expect(serverProcess.Out).To(gbytes.Say("stopped"))
+		})
+
+		It("can list the directory on the server", func() {
+			lsCmd := exec.Command(binPath, "ls", "-recursive", "-checksums", "-json", fmt.Sprintf("localhost:%d:/d1", serverPort))
+			lsProcess, err := gexec.Start(lsCmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(lsProcess).Should(gexec.Exit(0))
+
+			var entries []map[string]interface{}
+			Expect(json.Unmarshal(lsProcess.Out.Contents(), &entries)).To(Succeed())
+			Expect(entries).To(HaveLen(3))
+			Expect(entries[0]).To(HaveKeyWithValue("path", "b.txt"))
+			Expect(entries[0]).To(HaveKeyWithValue("mode", "-rw-r--r--"))
+			Expect(entries[0]).To(HaveKeyWithValue("md5", "2cb9fa5861d1d2f0c3551c4a658f14bc"))
+			Expect(entries[1]).To(HaveKeyWithValue("path", "d2"))
+			Expect(entries[1]).To(HaveKeyWithValue("is_dir", true))
+			Expect(entries[2]).To(HaveKeyWithValue("path", "d2/c.txt"))
+		})
 	})
 })
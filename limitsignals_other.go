@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"log"
+
+	"github.com/craigfurman/ezxfer/ratelimit"
+)
+
+// watchLimitSignals does nothing on platforms without SIGUSR1 and SIGUSR2.
+func watchLimitSignals(logger *log.Logger, limiters ...*ratelimit.Limiter) {}
@@ -0,0 +1,40 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/craigfurman/ezxfer/ratelimit"
+)
+
+// watchLimitSignals halves the rate of limiters on SIGUSR1 and doubles it on
+// SIGUSR2, for the life of the process. Halving stops at 1 B/s, as a rate of
+// 0 would lift the limit.
+func watchLimitSignals(logger *log.Logger, limiters ...*ratelimit.Limiter) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			for _, limiter := range limiters {
+				if limiter.Rate() == 0 {
+					continue
+				}
+				if sig == syscall.SIGUSR1 {
+					rate := limiter.Rate() / 2
+					if rate < 1 {
+						rate = 1
+					}
+					limiter.SetRate(rate)
+				} else {
+					limiter.SetRate(limiter.Rate() * 2)
+				}
+				logger.Printf("bandwidth limit changed to %s", ratelimit.FormatRate(limiter.Rate()))
+			}
+		}
+	}()
+}
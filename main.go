@@ -1,60 +1,166 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 
 	"github.com/craigfurman/ezxfer/client"
-	"github.com/craigfurman/ezxfer/server"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
-	pb "gopkg.in/cheggaaa/pb.v1"
+// Exit codes, one per class of error.
+const (
+	exitOK         = 0
+	exitFailure    = 1
+	exitUsage      = 2
+	exitConnection = 3
+	exitLocalFile  = 4
+	exitRemote     = 5
 )
 
+type command struct {
+	name    string
+	args    string
+	summary string
+	// setup defines the command's flags and returns a function that runs the
+	// command with the arguments left after parsing them.
+	setup func(flags *flag.FlagSet) func(args []string) error
+}
+
+var commands = []*command{
+	serveCommand,
+	sendCommand,
+	getCommand,
+	lsCommand,
+	rmCommand,
+	mvCommand,
+	mkdirCommand,
+	versionsCommand,
+	versionCommand,
+}
+
 func main() {
-	file := flag.String("file", "", "")
-	dstHost := flag.String("dstHost", "", "")
-	dstPort := flag.Int("dstPort", 0, "")
-
-	serverPort := flag.Int("serveOnPort", 0, "")
-	flag.Parse()
-
-	if *serverPort != 0 {
-		logger := createLogger("[ezxfer server] ")
-		logger.Println("-serveOnPort is set, starting in server mode")
-		cwd, err := os.Getwd()
-		if err != nil {
-			logger.Println(err)
-			os.Exit(1)
-		}
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
 
-		srv := server.Server{Port: *serverPort, DestDir: cwd, Logger: logger}
-		if err := srv.ServeTCP(context.Background()); err != nil {
-			logger.Println(err)
-			os.Exit(1)
+func run(args []string, stderr io.Writer) int {
+	if len(args) == 0 {
+		printUsage(stderr)
+		return exitUsage
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		printUsage(stderr)
+		return exitOK
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(stderr, "ezxfer: unknown command %q\n\n", args[0])
+		printUsage(stderr)
+		return exitUsage
+	}
+
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: ezxfer %s [flags] %s\n\n%s\n", cmd.name, cmd.args, cmd.summary)
+		fmt.Fprintln(stderr, "\nflags:")
+		flags.PrintDefaults()
+	}
+	runCmd := cmd.setup(flags)
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
 		}
+		return exitUsage
 	}
 
-	c := client.Client{ProgressBarFactory: &progressBarFactory{}}
+	err := runCmd(flags.Args())
+	if err == nil {
+		return exitOK
+	}
 
-	logger := createLogger("[ezxfer] ")
-	logger.Printf("will transfer file %s to %s:%d...\n", *file, *dstHost, *dstPort)
-	if err := c.Send(*file, fmt.Sprintf("%s:%d", *dstHost, *dstPort)); err != nil {
-		logger.Println(err)
-		os.Exit(1)
+	fmt.Fprintf(stderr, "ezxfer %s: %s\n", cmd.name, err)
+	var usageErr usageError
+	if errors.As(err, &usageErr) {
+		fmt.Fprintln(stderr)
+		flags.Usage()
+		return exitUsage
 	}
+	return exitCode(err)
+}
 
-	logger.Println("done!")
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
 }
 
-func createLogger(prefix string) *log.Logger {
-	return log.New(os.Stdout, prefix, log.LstdFlags)
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: ezxfer <command> [flags] [args]")
+	fmt.Fprintln(w, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-9s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w, "\nRun 'ezxfer <command> -h' for help with a command.")
+}
+
+// usageError is returned by commands that were invoked incorrectly.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// expectArgs returns a usageError unless there are between min and max args.
+func expectArgs(args []string, min, max int) error {
+	if len(args) < min {
+		return usageError("not enough arguments")
+	}
+	if len(args) > max {
+		return usageError(fmt.Sprintf("unexpected arguments: %v", args[max:]))
+	}
+	return nil
 }
 
-type progressBarFactory struct{}
+// parseDestination parses a host:port[:/path] argument, treating malformed
+// destinations as usage errors.
+func parseDestination(arg string) (client.Destination, error) {
+	dest, err := client.ParseDestination(arg)
+	if err != nil {
+		return dest, usageError(err.Error())
+	}
+	return dest, nil
+}
 
-func (*progressBarFactory) New(fileSize int64) client.ProgressBar {
-	return pb.New64(fileSize).SetUnits(pb.U_BYTES).Start()
+func exitCode(err error) int {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return exitConnection
+	}
+	var serverErr *client.ServerError
+	var busyErr *client.BusyError
+	if errors.As(err, &serverErr) || errors.As(err, &busyErr) {
+		return exitRemote
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return exitLocalFile
+	}
+	return exitFailure
+}
+
+func createLogger(prefix string) *log.Logger {
+	return log.New(os.Stdout, prefix, log.LstdFlags)
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/craigfurman/ezxfer/client"
+	"github.com/craigfurman/ezxfer/config"
+	"github.com/craigfurman/ezxfer/ratelimit"
+)
+
+// loadConfig loads a config file into the values that flags are bound to. The
+// flags given on the command line are then applied again, followed by
+// environment variables, so that flags override the file and environment
+// variables override both.
+func loadConfig(flags *flag.FlagSet, load func() error) error {
+	if err := applyEnv(flags, "config"); err != nil {
+		return err
+	}
+	explicit := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	if err := load(); err != nil {
+		return err
+	}
+
+	for name, value := range explicit {
+		if err := flags.Set(name, value); err != nil {
+			return err
+		}
+	}
+	var names []string
+	flags.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+	return applyEnv(flags, names...)
+}
+
+// applyEnv sets each named flag from its environment variable, if set.
+func applyEnv(flags *flag.FlagSet, names ...string) error {
+	for _, name := range names {
+		if flags.Lookup(name) == nil {
+			continue
+		}
+		if value, ok := os.LookupEnv(envName(name)); ok {
+			if err := flags.Set(name, value); err != nil {
+				return usageError(fmt.Sprintf("invalid value %q for %s: %s", value, envName(name), err))
+			}
+		}
+	}
+	return nil
+}
+
+// envName returns the environment variable for a flag, e.g. EZXFER_ALLOW_READ
+// for -allowRead.
+func envName(flagName string) string {
+	var name []rune
+	for i, r := range flagName {
+		if i > 0 && unicode.IsUpper(r) && unicode.IsLower(rune(flagName[i-1])) {
+			name = append(name, '_')
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+	return "EZXFER_" + string(name)
+}
+
+// stringList is a flag holding a comma separated list.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// clientOptions are the flags every command that talks to a server takes.
+type clientOptions struct {
+	configPath     string
+	token          string
+	tlsFingerprint string
+	busyRetries    int
+	limit          string
+	progress       string
+	output         string
+}
+
+func addClientFlags(flags *flag.FlagSet) *clientOptions {
+	opts := new(clientOptions)
+	flags.StringVar(&opts.configPath, "config", config.ClientPath(), "path to the client config file")
+	flags.StringVar(&opts.token, "token", "", "token to present to the server")
+	flags.StringVar(&opts.tlsFingerprint, "tlsFingerprint", "", "SHA-256 fingerprint of the server's TLS certificate; connects over TLS when set")
+	flags.IntVar(&opts.busyRetries, "busyRetries", 3, "how many times to retry when the server is busy")
+	flags.StringVar(&opts.limit, "limit", "", "bandwidth limit, e.g. 20MB/s; SIGUSR1 halves it and SIGUSR2 doubles it")
+	flags.StringVar(&opts.progress, "progress", progressOverall, "progress to show: overall, for a single bar for the whole transfer, files, for a bar per file, or none")
+	opts.output = outputText
+	return opts
+}
+
+// addOutputFlag lets commands that transfer files choose how they report
+// them.
+func (o *clientOptions) addOutputFlag(flags *flag.FlagSet) {
+	flags.StringVar(&o.output, "output", outputText, "output format: text, for logs and progress, or json, for a JSON event per line and a final summary, with logs on stderr")
+}
+
+// logger returns the logger for a command's messages, which are kept out of
+// JSON output.
+func (o *clientOptions) logger() *log.Logger {
+	if o.output == outputJSON {
+		return log.New(os.Stderr, "[ezxfer] ", log.LstdFlags)
+	}
+	return createLogger("[ezxfer] ")
+}
+
+// newClient resolves a destination argument, which is either host:port[:path]
+// or the name of a remote from the config file followed by an optional
+// :path, and returns a client configured to connect to it.
+func (o *clientOptions) newClient(flags *flag.FlagSet, destArg string) (*client.Client, client.Destination, error) {
+	var dest client.Destination
+	err := loadConfig(flags, func() error {
+		cfg, err := config.LoadClient(o.configPath)
+		if err != nil {
+			return err
+		}
+
+		name, path := destArg, ""
+		if i := strings.Index(destArg, ":"); i >= 0 {
+			name, path = destArg[:i], destArg[i+1:]
+		}
+		remote, ok := cfg.Remotes[name]
+		if !ok {
+			dest, err = parseDestination(destArg)
+			return err
+		}
+
+		if path == "" {
+			path = remote.RemoteDir
+		}
+		dest = client.Destination{Address: net.JoinHostPort(remote.Host, strconv.Itoa(remote.Port)), Path: path}
+		o.token = remote.Token
+		o.tlsFingerprint = remote.TLSFingerprint
+		return nil
+	})
+	if err != nil {
+		return nil, dest, err
+	}
+	rate, err := ratelimit.ParseRate(o.limit)
+	if err != nil {
+		return nil, dest, usageError(err.Error())
+	}
+	limiter := ratelimit.NewLimiter(rate)
+	watchLimitSignals(o.logger(), limiter)
+
+	c := &client.Client{
+		Token:          o.token,
+		TLSFingerprint: o.tlsFingerprint,
+		BusyRetries:    o.busyRetries,
+		Limiter:        limiter,
+	}
+	switch o.output {
+	case outputText:
+	case outputJSON:
+		// Progress is reported in the JSON events instead.
+		c.Observer = newJSONOutput(os.Stdout)
+		return c, dest, nil
+	default:
+		return nil, dest, usageError(fmt.Sprintf("unknown output %q, expected one of [%s %s]", o.output, outputText, outputJSON))
+	}
+	switch o.progress {
+	case progressOverall:
+		c.Observer = new(client.Progress)
+	case progressFiles:
+		c.Observer = newFileBars()
+	case progressNone:
+	default:
+		return nil, dest, usageError(fmt.Sprintf("unknown progress %q, expected one of [%s %s %s]", o.progress, progressOverall, progressFiles, progressNone))
+	}
+	return c, dest, nil
+}
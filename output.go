@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/ezxfer/client"
+	"github.com/craigfurman/ezxfer/protocol"
+)
+
+// Output formats, chosen with -output.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// bytesSentInterval is how often jsonOutput writes bytes_sent for a file
+// being sent.
+const bytesSentInterval = time.Second
+
+// jsonOutput is an Observer that writes each event of a transfer as a line of
+// JSON, ending with a summary of the whole transfer. The schema is documented
+// in the README, and fields are only ever added to it.
+type jsonOutput struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	op      string
+	sent    int64
+	files   []jsonFileStatus
+	// progress is the files whose bytes are being sent, by path.
+	progress map[string]*jsonFileProgress
+}
+
+// jsonFileProgress is what is sent of a file, and what of it is yet to be
+// written as bytes_sent.
+type jsonFileProgress struct {
+	size     int64
+	sent     int64
+	unsent   int64
+	reported time.Time
+}
+
+type jsonEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+}
+
+type jsonTransferStarted struct {
+	jsonEvent
+	Op    string `json:"op"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+type jsonFileStarted struct {
+	jsonEvent
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+type jsonBytesSent struct {
+	jsonEvent
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+	// Total is the bytes sent so far of the whole transfer.
+	Total int64 `json:"total"`
+}
+
+type jsonRetrying struct {
+	jsonEvent
+	Attempt      int     `json:"attempt"`
+	DelaySeconds float64 `json:"delay_seconds"`
+	Error        string  `json:"error"`
+}
+
+// jsonFileStatus is both the event for a file verified or failed, and its
+// entry in the summary.
+type jsonFileStatus struct {
+	Path    string          `json:"path"`
+	Status  string          `json:"status"`
+	Action  protocol.Action `json:"action,omitempty"`
+	SavedAs string          `json:"saved_as,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type jsonFileEvent struct {
+	jsonEvent
+	jsonFileStatus
+}
+
+type jsonSummary struct {
+	jsonEvent
+	Op              string           `json:"op"`
+	OK              bool             `json:"ok"`
+	Error           string           `json:"error,omitempty"`
+	Files           int              `json:"files"`
+	Bytes           int64            `json:"bytes"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	BytesPerSecond  int64            `json:"bytes_per_second"`
+	FileStatuses    []jsonFileStatus `json:"file_statuses"`
+}
+
+// File statuses.
+const (
+	statusVerified = "verified"
+	statusFailed   = "failed"
+)
+
+func newJSONOutput(w io.Writer) *jsonOutput {
+	return &jsonOutput{encoder: json.NewEncoder(w)}
+}
+
+func (o *jsonOutput) Observe(event client.Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now().UTC()
+	switch e := event.(type) {
+	case client.TransferStarted:
+		o.op, o.sent, o.files = e.Op, 0, []jsonFileStatus{}
+		o.progress = map[string]*jsonFileProgress{}
+		o.write(jsonTransferStarted{jsonEvent: jsonEvent{"transfer_started", now}, Op: e.Op, Files: e.Files, Bytes: e.Size})
+	case client.FileStarted:
+		o.fileProgress(e.Path, now).size = e.Size
+		o.write(jsonFileStarted{jsonEvent: jsonEvent{"file_started", now}, Path: e.Path, Bytes: e.Size})
+	case client.BytesSent:
+		o.sent += e.N
+		progress := o.fileProgress(e.Path, now)
+		progress.sent += e.N
+		progress.unsent += e.N
+		if (progress.size > 0 && progress.sent >= progress.size) || now.Sub(progress.reported) >= bytesSentInterval {
+			o.bytesSent(now, e.Path)
+			progress.reported = now
+		}
+	case client.FileVerified:
+		o.bytesSent(now, e.Path)
+		o.file(now, "file_verified", jsonFileStatus{Path: e.Path, Status: statusVerified, Action: e.Action, SavedAs: e.SavedAs})
+	case client.FileFailed:
+		o.bytesSent(now, e.Path)
+		o.file(now, "file_failed", jsonFileStatus{Path: e.Path, Status: statusFailed, Error: e.Err.Error()})
+	case client.Retrying:
+		o.write(jsonRetrying{jsonEvent: jsonEvent{"retrying", now}, Attempt: e.Attempt, DelaySeconds: e.Delay.Seconds(), Error: e.Err.Error()})
+	case client.TransferDone:
+		var unfinished []string
+		for path := range o.progress {
+			unfinished = append(unfinished, path)
+		}
+		sort.Strings(unfinished)
+		for _, path := range unfinished {
+			o.bytesSent(now, path)
+		}
+		summary := jsonSummary{
+			jsonEvent:       jsonEvent{"summary", now},
+			Op:              o.op,
+			OK:              e.Err == nil,
+			Files:           e.Files,
+			Bytes:           e.Bytes,
+			DurationSeconds: e.Duration.Seconds(),
+			FileStatuses:    o.files,
+		}
+		if e.Err != nil {
+			summary.Error = e.Err.Error()
+		}
+		if e.Duration > 0 {
+			summary.BytesPerSecond = int64(float64(e.Bytes) / e.Duration.Seconds())
+		}
+		o.write(summary)
+	}
+}
+
+// fileProgress returns the progress of the file at path, starting it if it is
+// not being sent.
+func (o *jsonOutput) fileProgress(path string, now time.Time) *jsonFileProgress {
+	if o.progress == nil {
+		o.progress = map[string]*jsonFileProgress{}
+	}
+	progress, ok := o.progress[path]
+	if !ok {
+		progress = &jsonFileProgress{reported: now}
+		o.progress[path] = progress
+	}
+	return progress
+}
+
+// bytesSent writes bytes_sent for what is sent of the file at path since it
+// was last written, if anything.
+func (o *jsonOutput) bytesSent(now time.Time, path string) {
+	progress, ok := o.progress[path]
+	if !ok || progress.unsent == 0 {
+		return
+	}
+	o.write(jsonBytesSent{jsonEvent: jsonEvent{"bytes_sent", now}, Path: path, Bytes: progress.unsent, Total: o.sent})
+	progress.unsent = 0
+}
+
+func (o *jsonOutput) file(now time.Time, event string, status jsonFileStatus) {
+	delete(o.progress, status.Path)
+	o.files = append(o.files, status)
+	o.write(jsonFileEvent{jsonEvent: jsonEvent{event, now}, jsonFileStatus: status})
+}
+
+// write writes a line of JSON. There is nowhere to report failing to, so
+// errors are ignored.
+func (o *jsonOutput) write(v interface{}) {
+	o.encoder.Encode(v)
+}
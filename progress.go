@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/ezxfer/client"
+
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// Progress modes, chosen with -progress.
+const (
+	progressOverall = "overall"
+	progressFiles   = "files"
+	progressNone    = "none"
+)
+
+const progressInterval = 200 * time.Millisecond
+
+// showProgress draws a single bar for the whole of a transfer made by c, with
+// the file being sent, how many files are done, throughput and time left. It
+// draws nothing unless c's Observer is a Progress. The returned function stops
+// it once the transfer is over.
+func showProgress(c *client.Client) func() {
+	progress, ok := c.Observer.(*client.Progress)
+	if !ok {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		var bar *pb.ProgressBar
+		for {
+			var finished bool
+			select {
+			case <-done:
+				finished = true
+			case <-ticker.C:
+			}
+
+			snapshot := progress.Snapshot()
+			// The totals are only known once the transfer has started.
+			if bar == nil && (snapshot.Elapsed > 0 || finished) {
+				bar = pb.New64(snapshot.Size).SetUnits(pb.U_BYTES).Prefix(progressPrefix(snapshot))
+				bar.ShowSpeed = true
+				bar.Start()
+			}
+			if bar != nil {
+				bar.Prefix(progressPrefix(snapshot))
+				bar.Set64(snapshot.Sent)
+			}
+			if finished {
+				if bar != nil {
+					bar.Finish()
+				}
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// progressPrefix shows the file being sent, shortened from the start, and how
+// many files are done.
+func progressPrefix(snapshot client.ProgressSnapshot) string {
+	const maxName = 30
+	name := snapshot.Current
+	if len(name) > maxName {
+		name = "..." + name[len(name)-maxName+3:]
+	}
+	files := fmt.Sprintf("%d", snapshot.FilesDone)
+	if snapshot.Files > 0 {
+		files = fmt.Sprintf("%d/%d", snapshot.FilesDone, snapshot.Files)
+	}
+	return fmt.Sprintf("%-*s %s files ", maxName, name, files)
+}
+
+// fileBars is an Observer that draws a bar for each file as it is sent.
+type fileBars struct {
+	mu   sync.Mutex
+	bars map[string]*fileBar
+}
+
+type fileBar struct {
+	*pb.ProgressBar
+	remaining int64
+}
+
+func newFileBars() *fileBars {
+	return &fileBars{bars: map[string]*fileBar{}}
+}
+
+func (b *fileBars) Observe(event client.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch e := event.(type) {
+	case client.FileStarted:
+		bar := pb.New64(e.Size).SetUnits(pb.U_BYTES).Start()
+		if e.Size == 0 {
+			bar.Finish()
+			return
+		}
+		b.bars[e.Path] = &fileBar{ProgressBar: bar, remaining: e.Size}
+	case client.BytesSent:
+		bar, ok := b.bars[e.Path]
+		if !ok {
+			return
+		}
+		bar.Add64(e.N)
+		if bar.remaining -= e.N; bar.remaining <= 0 {
+			b.finish(e.Path)
+		}
+	case client.FileFailed:
+		b.finish(e.Path)
+	case client.TransferDone:
+		for path := range b.bars {
+			b.finish(path)
+		}
+	}
+}
+
+func (b *fileBars) finish(path string) {
+	if bar, ok := b.bars[path]; ok {
+		bar.Finish()
+		delete(b.bars, path)
+	}
+}
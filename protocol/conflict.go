@@ -0,0 +1,60 @@
+package protocol
+
+import "fmt"
+
+// ConflictPolicy decides what the server does when a file it receives
+// already exists.
+type ConflictPolicy string
+
+const (
+	ConflictFail             ConflictPolicy = "fail"
+	ConflictSkip             ConflictPolicy = "skip"
+	ConflictRename           ConflictPolicy = "rename"
+	ConflictOverwriteIfNewer ConflictPolicy = "overwrite-if-newer"
+	ConflictOverwrite        ConflictPolicy = "overwrite"
+)
+
+// conflictPolicies is ordered from least to most destructive.
+var conflictPolicies = []ConflictPolicy{
+	ConflictFail,
+	ConflictSkip,
+	ConflictRename,
+	ConflictOverwriteIfNewer,
+	ConflictOverwrite,
+}
+
+func ParseConflictPolicy(policy string) (ConflictPolicy, error) {
+	for _, p := range conflictPolicies {
+		if string(p) == policy {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, expected one of %v", policy, conflictPolicies)
+}
+
+// Cap returns p, or max if p is more destructive than max.
+func (p ConflictPolicy) Cap(max ConflictPolicy) ConflictPolicy {
+	if p.rank() > max.rank() {
+		return max
+	}
+	return p
+}
+
+func (p ConflictPolicy) rank() int {
+	for i, policy := range conflictPolicies {
+		if policy == p {
+			return i
+		}
+	}
+	return len(conflictPolicies)
+}
+
+// Action records what the server did with a file it received.
+type Action string
+
+const (
+	ActionCreated     Action = "created"
+	ActionOverwritten Action = "overwritten"
+	ActionSkipped     Action = "skipped"
+	ActionRenamed     Action = "renamed"
+)
@@ -0,0 +1,33 @@
+package protocol
+
+// ErrorCode classifies the errors a server reports, so that clients can act
+// on them without parsing messages.
+type ErrorCode string
+
+const (
+	// CodeUnauthorized is reported when the client's token is not valid.
+	CodeUnauthorized ErrorCode = "unauthorized"
+	// CodePermissionDenied is reported for operations the server does not
+	// allow, and for files it cannot access.
+	CodePermissionDenied ErrorCode = "permission_denied"
+	// CodeInvalidPath is reported for paths outside of the server root, or
+	// reserved by the server.
+	CodeInvalidPath ErrorCode = "invalid_path"
+	// CodeInvalidRequest is reported for requests the server cannot
+	// understand or carry out as asked.
+	CodeInvalidRequest ErrorCode = "invalid_request"
+	CodeNotFound       ErrorCode = "not_found"
+	// CodeConflict is reported when a path already exists.
+	CodeConflict ErrorCode = "conflict"
+	// CodeChecksum is reported when a received file does not match its
+	// checksum.
+	CodeChecksum ErrorCode = "checksum_mismatch"
+	// CodeNoSpace is reported when the server's filesystem is full.
+	CodeNoSpace ErrorCode = "no_space"
+	// CodeQuotaExceeded is reported when a send would exceed a quota.
+	CodeQuotaExceeded ErrorCode = "quota_exceeded"
+	// CodeBusy is reported when the server is too busy, or shutting down.
+	CodeBusy ErrorCode = "busy"
+	// CodeInternal is reported for any other failure.
+	CodeInternal ErrorCode = "internal"
+)
@@ -0,0 +1,136 @@
+// Package protocol defines the messages a client and server exchange around
+// the tar stream. Each message is a single line of JSON.
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// OpPut sends files to the server.
+	OpPut = "put"
+	// OpGet fetches files from the server.
+	OpGet = "get"
+	// OpList lists files on the server.
+	OpList = "ls"
+	// OpRemove deletes a file or directory on the server.
+	OpRemove = "rm"
+	// OpMove moves a file or directory on the server.
+	OpMove = "mv"
+	// OpMkdir creates a directory, and any missing parents, on the server.
+	OpMkdir = "mkdir"
+)
+
+// Request is sent by the client as soon as it connects.
+type Request struct {
+	Op string `json:"op"`
+	// Token authenticates the client to servers that require one.
+	Token string `json:"token,omitempty"`
+	// Path is, relative to the server's root, the directory that files are
+	// written to for OpPut, or the file or directory that the other
+	// operations act on.
+	Path string `json:"path,omitempty"`
+	// To is the path, relative to the server's root, that OpMove moves Path
+	// to.
+	To string `json:"to,omitempty"`
+	// Rename, if set, is the name a single transferred file is saved under.
+	Rename string `json:"rename,omitempty"`
+	// ConflictPolicy is the policy the client would like applied to files
+	// that already exist. The server's default is used if it is empty.
+	ConflictPolicy ConflictPolicy `json:"conflict_policy,omitempty"`
+	// Recursive lists the whole tree under Path for OpList, rather than only
+	// its immediate children, and lets OpRemove delete non-empty directories.
+	Recursive bool `json:"recursive,omitempty"`
+	// Checksums includes each file's MD5 checksum in an OpList listing.
+	Checksums bool `json:"checksums,omitempty"`
+	// Size is the total number of bytes an OpPut will send, so that the
+	// server can check it has room for them before accepting.
+	Size int64 `json:"size,omitempty"`
+	// TransferID identifies the streams of an OpPut sent over several
+	// connections at once, of which there are Streams. The server replies to
+	// each with the combined result of all of them.
+	TransferID string `json:"transfer_id,omitempty"`
+	Streams    int    `json:"streams,omitempty"`
+	// Stripe, if set, makes the stream of an OpPut with several streams a
+	// byte range of a single file, rather than whole files.
+	Stripe *Stripe `json:"stripe,omitempty"`
+}
+
+// Stripe is a byte range of a single file that is sent over several
+// connections at once. Its tar stream has one entry, named after the file,
+// holding the range and the checksum of the whole file.
+type Stripe struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	// FileSize is the size of the whole file.
+	FileSize int64 `json:"file_size"`
+}
+
+// Response is the server's reply to a Request. The tar stream, in whichever
+// direction, only follows a Response with no Error.
+type Response struct {
+	Error string    `json:"error,omitempty"`
+	Code  ErrorCode `json:"code,omitempty"`
+	// ConflictPolicy is the policy the server will apply, which may be less
+	// destructive than the one requested.
+	ConflictPolicy ConflictPolicy `json:"conflict_policy,omitempty"`
+	// Entries is the listing requested by OpList.
+	Entries []Entry `json:"entries,omitempty"`
+	// RetryAfter is set, in seconds, when the server is too busy to accept
+	// the request and the client may try again later.
+	RetryAfter int `json:"retry_after,omitempty"`
+	// Batches is set when the server accepts small files gathered into
+	// batch entries in the tar stream of an OpPut.
+	Batches bool `json:"batches,omitempty"`
+	// Results is set when the server follows the tar stream of an OpGet
+	// with a Result, reporting whether every file was sent.
+	Results bool `json:"results,omitempty"`
+}
+
+// Entry describes a file or directory in a listing.
+type Entry struct {
+	// Path is relative to the listed path.
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	MD5     string      `json:"md5,omitempty"`
+}
+
+// Result is sent by the server once it has received the whole tar stream, or
+// as soon as it fails to save a file. For gets, it follows the tar stream.
+type Result struct {
+	Error string       `json:"error,omitempty"`
+	Code  ErrorCode    `json:"code,omitempty"`
+	Files []FileResult `json:"files"`
+}
+
+type FileResult struct {
+	// Path is the file's path as sent by the client.
+	Path   string `json:"path"`
+	Action Action `json:"action"`
+	// SavedAs is the path, relative to the requested directory, that the file
+	// was saved to when it differs from Path.
+	SavedAs string `json:"saved_as,omitempty"`
+}
+
+func WriteMessage(w io.Writer, msg interface{}) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+func ReadMessage(r *bufio.Reader, msg interface{}) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, msg)
+}
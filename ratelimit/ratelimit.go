@@ -0,0 +1,213 @@
+// Package ratelimit throttles streams with token buckets.
+package ratelimit
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/craigfurman/ezxfer/units"
+)
+
+const maxChunk = 32 * 1024
+
+// Limiter is a token bucket that limits a rate in bytes per second. It can be
+// shared between streams, and its rate changed while they are in progress. A
+// nil Limiter, or one with a rate of 0, does not limit anything.
+type Limiter struct {
+	rate *int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	return &Limiter{rate: &bytesPerSecond}
+}
+
+// Split returns a limiter with its own bucket, so that it limits streams
+// separately from l, but with the same rate as l, including changes to it.
+func (l *Limiter) Split() *Limiter {
+	if l == nil {
+		return nil
+	}
+	return &Limiter{rate: l.rate}
+}
+
+// Rate returns the limit in bytes per second.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(l.rate)
+}
+
+// SetRate changes the limit, 0 for no limit.
+func (l *Limiter) SetRate(bytesPerSecond int64) {
+	atomic.StoreInt64(l.rate, bytesPerSecond)
+}
+
+// WaitN blocks until n bytes may pass.
+func (l *Limiter) WaitN(n int) {
+	if delay := l.reserve(n); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// reserve takes n tokens from the bucket, which may leave it in debt, and
+// returns how long to wait for the debt to be repaid.
+func (l *Limiter) reserve(n int) time.Duration {
+	rate := float64(l.Rate())
+	if rate <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.tokens+now.Sub(l.last).Seconds()*rate, float64(chunkSize(int64(rate))))
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// chunkSize is how many bytes are let through at once at a rate, so that the
+// stream is throttled smoothly.
+func chunkSize(rate int64) int {
+	chunk := rate / 20
+	if chunk < 512 {
+		return 512
+	}
+	if chunk > maxChunk {
+		return maxChunk
+	}
+	return int(chunk)
+}
+
+func chunkFor(limiters []*Limiter) int {
+	chunk := maxChunk
+	for _, l := range limiters {
+		if rate := l.Rate(); rate > 0 && chunkSize(rate) < chunk {
+			chunk = chunkSize(rate)
+		}
+	}
+	return chunk
+}
+
+func waitAll(limiters []*Limiter, n int) {
+	for _, l := range limiters {
+		l.WaitN(n)
+	}
+}
+
+type reader struct {
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// NewReader returns a reader limited by every one of limiters. Nil limiters
+// are ignored.
+func NewReader(r io.Reader, limiters ...*Limiter) io.Reader {
+	return &reader{r: r, limiters: nonNil(limiters)}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(r.limiters) == 0 {
+		return r.r.Read(p)
+	}
+	if chunk := chunkFor(r.limiters); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.r.Read(p)
+	waitAll(r.limiters, n)
+	return n, err
+}
+
+type writer struct {
+	w        io.Writer
+	limiters []*Limiter
+}
+
+// NewWriter returns a writer limited by every one of limiters. Nil limiters
+// are ignored.
+func NewWriter(w io.Writer, limiters ...*Limiter) io.Writer {
+	return &writer{w: w, limiters: nonNil(limiters)}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if len(w.limiters) == 0 {
+		return w.w.Write(p)
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := chunkFor(w.limiters)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		waitAll(w.limiters, chunk)
+		n, err := w.w.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// ReadFrom hands r straight to the underlying writer while none of the
+// limiters has a limit, so that a TCP connection can send files with
+// sendfile(2). io.Copy calls it in place of Write.
+func (w *writer) ReadFrom(r io.Reader) (int64, error) {
+	if readerFrom, ok := w.w.(io.ReaderFrom); ok && unlimited(w.limiters) {
+		return readerFrom.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+func unlimited(limiters []*Limiter) bool {
+	for _, l := range limiters {
+		if l.Rate() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func nonNil(limiters []*Limiter) []*Limiter {
+	var result []*Limiter
+	for _, l := range limiters {
+		if l != nil {
+			result = append(result, l)
+		}
+	}
+	return result
+}
+
+// ParseRate parses a rate such as 20MB/s or 512KiB/s into bytes per second.
+// The /s suffix is optional, and an empty string or 0 means no limit.
+func ParseRate(rate string) (int64, error) {
+	bytesPerSecond, err := units.ParseBytes(strings.TrimSuffix(strings.TrimSpace(rate), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q, expected e.g. 20MB/s", rate)
+	}
+	return bytesPerSecond, nil
+}
+
+// FormatRate formats a rate in bytes per second, as accepted by ParseRate.
+func FormatRate(bytesPerSecond int64) string {
+	if bytesPerSecond <= 0 {
+		return "unlimited"
+	}
+	return units.FormatBytes(bytesPerSecond) + "/s"
+}
@@ -0,0 +1,105 @@
+package ratelimit_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/craigfurman/ezxfer/ratelimit"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rate limiting", func() {
+	content := bytes.Repeat([]byte("x"), 50*1000)
+
+	timeCopy := func(dst io.Writer, src io.Reader) time.Duration {
+		start := time.Now()
+		n, err := io.Copy(dst, src)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(int64(len(content))))
+		return time.Since(start)
+	}
+
+	It("limits readers to the rate", func() {
+		limiter := ratelimit.NewLimiter(100 * 1000)
+		elapsed := timeCopy(ioutil.Discard, ratelimit.NewReader(bytes.NewReader(content), limiter))
+		Expect(elapsed).To(BeNumerically("~", 500*time.Millisecond, 100*time.Millisecond))
+	})
+
+	It("limits writers to the rate", func() {
+		limiter := ratelimit.NewLimiter(100 * 1000)
+		elapsed := timeCopy(ratelimit.NewWriter(ioutil.Discard, limiter), bytes.NewReader(content))
+		Expect(elapsed).To(BeNumerically("~", 500*time.Millisecond, 100*time.Millisecond))
+	})
+
+	It("applies the slowest of several limiters", func() {
+		elapsed := timeCopy(ioutil.Discard, ratelimit.NewReader(bytes.NewReader(content), ratelimit.NewLimiter(1000*1000), ratelimit.NewLimiter(100*1000), nil))
+		Expect(elapsed).To(BeNumerically("~", 500*time.Millisecond, 100*time.Millisecond))
+	})
+
+	It("does not limit without a rate", func() {
+		elapsed := timeCopy(ioutil.Discard, ratelimit.NewReader(bytes.NewReader(content), ratelimit.NewLimiter(0), nil))
+		Expect(elapsed).To(BeNumerically("<", 50*time.Millisecond))
+	})
+
+	It("shares a bucket between streams", func() {
+		limiter := ratelimit.NewLimiter(200 * 1000)
+		done := make(chan time.Duration, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				defer GinkgoRecover()
+				done <- timeCopy(ioutil.Discard, ratelimit.NewReader(bytes.NewReader(content), limiter))
+			}()
+		}
+		Expect(<-done).To(BeNumerically(">", 400*time.Millisecond))
+		Expect(<-done).To(BeNumerically("~", 500*time.Millisecond, 100*time.Millisecond))
+	})
+
+	It("gives split limiters their own bucket at the same rate", func() {
+		limiter := ratelimit.NewLimiter(0)
+		split := limiter.Split()
+		limiter.SetRate(100 * 1000)
+		Expect(split.Rate()).To(Equal(int64(100 * 1000)))
+
+		elapsed := timeCopy(ioutil.Discard, ratelimit.NewReader(bytes.NewReader(content), split))
+		Expect(elapsed).To(BeNumerically("~", 500*time.Millisecond, 100*time.Millisecond))
+	})
+
+	It("applies rate changes to streams in progress", func() {
+		limiter := ratelimit.NewLimiter(10 * 1000)
+		time.AfterFunc(200*time.Millisecond, func() { limiter.SetRate(0) })
+		elapsed := timeCopy(ioutil.Discard, ratelimit.NewReader(bytes.NewReader(content), limiter))
+		Expect(elapsed).To(BeNumerically("<", time.Second))
+	})
+
+	Describe("parsing rates", func() {
+		It("parses decimal and binary units, with or without /s", func() {
+			for rate, expected := range map[string]int64{
+				"20MB/s":   20 * 1000 * 1000,
+				"1.5KB/s":  1500,
+				"512KiB/s": 512 * 1024,
+				"1GiB":     1 << 30,
+				"100":      100,
+				"100B/s":   100,
+				"":         0,
+				"0":        0,
+			} {
+				Expect(ratelimit.ParseRate(rate)).To(Equal(expected), rate)
+			}
+		})
+
+		It("refuses invalid rates", func() {
+			_, err := ratelimit.ParseRate("fast")
+			Expect(err).To(MatchError(`invalid rate "fast", expected e.g. 20MB/s`))
+		})
+
+		It("formats rates", func() {
+			Expect(ratelimit.FormatRate(20 * 1000 * 1000)).To(Equal("20MB/s"))
+			Expect(ratelimit.FormatRate(1500)).To(Equal("1.5KB/s"))
+			Expect(ratelimit.FormatRate(100)).To(Equal("100B/s"))
+			Expect(ratelimit.FormatRate(0)).To(Equal("unlimited"))
+		})
+	})
+})
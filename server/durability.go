@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Durability decides when received files are synced to disk.
+type Durability string
+
+const (
+	// DurabilityNone leaves received files to be written back by the
+	// operating system.
+	DurabilityNone Durability = "none"
+	// DurabilityFile syncs each file, and the directories leading to it, as
+	// soon as it is received.
+	DurabilityFile Durability = "file"
+	// DurabilityBatch syncs every file received on a connection, and each
+	// directory leading to them once, before replying.
+	DurabilityBatch Durability = "batch"
+)
+
+var durabilities = []Durability{DurabilityNone, DurabilityFile, DurabilityBatch}
+
+func ParseDurability(durability string) (Durability, error) {
+	for _, d := range durabilities {
+		if string(d) == durability {
+			return d, nil
+		}
+	}
+	return "", fmt.Errorf("unknown durability %q, expected one of %v", durability, durabilities)
+}
+
+// syncer syncs the files received on a connection according to a Durability.
+type syncer struct {
+	durability Durability
+	root       string
+	files      []string
+	// syncPath syncs a single file or directory.
+	syncPath func(path string) error
+}
+
+func (s *Server) newSyncer() *syncer {
+	syncPath := s.syncPath
+	if syncPath == nil {
+		syncPath = fsyncPath
+	}
+	return &syncer{durability: s.Durability, root: s.DestDir, syncPath: syncPath}
+}
+
+// add syncs filePath now, or records it to be synced by flush.
+func (s *syncer) add(filePath string) error {
+	switch s.durability {
+	case DurabilityFile:
+		return s.sync([]string{filePath})
+	case DurabilityBatch:
+		s.files = append(s.files, filePath)
+	}
+	return nil
+}
+
+// flush syncs the files recorded by add.
+func (s *syncer) flush() error {
+	files := s.files
+	s.files = nil
+	return s.sync(files)
+}
+
+// sync syncs files, then each directory from theirs up to root, so that their
+// directory entries are durable too.
+func (s *syncer) sync(files []string) error {
+	dirs := map[string]bool{}
+	var ordered []string
+	for _, file := range files {
+		if err := s.syncPath(file); err != nil {
+			return err
+		}
+		for dir := filepath.Dir(file); !dirs[dir]; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+			ordered = append(ordered, dir)
+			if dir == s.root || dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+	for _, dir := range ordered {
+		if err := s.syncPath(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fsyncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/craigfurman/ezxfer/protocol"
+	"github.com/craigfurman/ezxfer/tarstream"
+)
+
+// codedError is an error reported to clients with a code.
+type codedError struct {
+	code protocol.ErrorCode
+	msg  string
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+func errorf(code protocol.ErrorCode, format string, args ...interface{}) error {
+	return &codedError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// errorCode returns the code that err is reported to clients with.
+func errorCode(err error) protocol.ErrorCode {
+	switch e := err.(type) {
+	case *codedError:
+		return e.code
+	case *busyError:
+		return protocol.CodeBusy
+	case *tarstream.ChecksumError:
+		return protocol.CodeChecksum
+	case *tarstream.SpaceError:
+		return protocol.CodeNoSpace
+	}
+
+	switch {
+	case os.IsPermission(err):
+		return protocol.CodePermissionDenied
+	case os.IsNotExist(err):
+		return protocol.CodeNotFound
+	case os.IsExist(err):
+		return protocol.CodeConflict
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), errors.Is(err, syscall.EFBIG):
+		return protocol.CodeNoSpace
+	}
+	return protocol.CodeInternal
+}
+
+// hideRoot rewrites filesystem errors in terms of the paths the client sent,
+// so that the server's root is not revealed, keeping their code.
+func hideRoot(err error, path, to string) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return errorf(errorCode(err), "%s %s: %s", e.Op, path, e.Err)
+	case *os.LinkError:
+		return errorf(errorCode(err), "%s %s %s: %s", e.Op, path, to, e.Err)
+	}
+	return err
+}
+
+// withPrefix prefixes the message of err, keeping its code.
+func withPrefix(prefix string, err error) error {
+	return errorf(errorCode(err), "%s: %s", prefix, err)
+}
@@ -0,0 +1,28 @@
+package server
+
+import "sync"
+
+// RecordSyncs makes s record the paths it syncs to disk, as well as syncing
+// them. The returned function returns those recorded so far.
+func (s *Server) RecordSyncs() func() []string {
+	var mu sync.Mutex
+	var synced []string
+	s.syncPath = func(path string) error {
+		mu.Lock()
+		synced = append(synced, path)
+		mu.Unlock()
+		return fsyncPath(path)
+	}
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), synced...)
+	}
+}
+
+// ClientUsage returns the bytes charged to client against its quota.
+func (s *Server) ClientUsage(client string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clientUsage[client]
+}
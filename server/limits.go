@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/ezxfer/protocol"
+)
+
+var (
+	errShuttingDown = errorf(protocol.CodeBusy, "server is shutting down")
+	errAborted      = errorf(protocol.CodeBusy, "transfer aborted: server is shutting down")
+)
+
+const defaultRetryAfter = 5 * time.Second
+
+// busyError is returned by admit when a transfer is over the server's limits.
+type busyError struct {
+	retryAfter int
+}
+
+func (e *busyError) Error() string {
+	return fmt.Sprintf("server busy, retry after %d seconds", e.retryAfter)
+}
+
+// transferSlots counts the transfers in progress. It is guarded by Server.mu.
+type transferSlots struct {
+	total int
+	perIP map[string]int
+	freed *sync.Cond
+}
+
+// admit reserves a transfer slot for the client at addr, waiting for one if
+// QueueWhenBusy is set. The returned function releases the slot.
+func (s *Server) admit(addr net.Addr) (func(), error) {
+	ip := clientIP(addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.slots.perIP == nil {
+		s.slots.perIP = map[string]int{}
+		s.slots.freed = sync.NewCond(&s.mu)
+	}
+
+	for !s.stopping && s.full(ip) {
+		if !s.QueueWhenBusy {
+			retryAfter := s.RetryAfter
+			if retryAfter <= 0 {
+				retryAfter = defaultRetryAfter
+			}
+			return nil, &busyError{retryAfter: int(math.Ceil(retryAfter.Seconds()))}
+		}
+		s.slots.freed.Wait()
+	}
+	if s.stopping {
+		return nil, errShuttingDown
+	}
+
+	s.slots.total++
+	s.slots.perIP[ip]++
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.slots.total--
+		if s.slots.perIP[ip]--; s.slots.perIP[ip] == 0 {
+			delete(s.slots.perIP, ip)
+		}
+		s.slots.freed.Broadcast()
+	}, nil
+}
+
+func clientIP(addr net.Addr) string {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
+	}
+	return ip
+}
+
+func (s *Server) full(ip string) bool {
+	return (s.MaxTransfers > 0 && s.slots.total >= s.MaxTransfers) ||
+		(s.MaxTransfersPerIP > 0 && s.slots.perIP[ip] >= s.MaxTransfersPerIP)
+}
+
+// stop refuses any further transfers, including those queued for a slot, and
+// stops streams waiting for the rest of their transfer.
+func (s *Server) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopping {
+		s.stopping = true
+		if s.stopped == nil {
+			s.stopped = make(chan struct{})
+		}
+		close(s.stopped)
+	}
+	if s.slots.freed != nil {
+		s.slots.freed.Broadcast()
+	}
+}
+
+// stopSignal returns a channel that is closed once the server stops.
+func (s *Server) stopSignal() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped == nil {
+		s.stopped = make(chan struct{})
+	}
+	return s.stopped
+}
+
+// refuseBusy replies to a request that admit refused.
+func (s *Server) refuseBusy(conn net.Conn, err error) {
+	resp := protocol.Response{Error: err.Error(), Code: errorCode(err)}
+	if busy, ok := err.(*busyError); ok {
+		resp.RetryAfter = busy.retryAfter
+	}
+	s.Logger.Printf("refusing %s: %s", conn.RemoteAddr(), err)
+	if err := protocol.WriteMessage(conn, resp); err != nil {
+		s.Logger.Println(err)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/craigfurman/ezxfer/protocol"
+	"github.com/craigfurman/ezxfer/tarstream"
+	"github.com/craigfurman/ezxfer/versions"
+)
+
+func (s *Server) handleList(conn net.Conn, req protocol.Request) {
+	if !s.Permissions.Read {
+		s.refuse(conn, errorf(protocol.CodePermissionDenied, "read access is not allowed"))
+		return
+	}
+
+	listPath, err := s.resolve(req.Path)
+	if err != nil {
+		s.refuse(conn, err)
+		return
+	}
+	entries, err := s.list(listPath, req.Recursive, req.Checksums)
+	if os.IsNotExist(err) {
+		err = errorf(protocol.CodeNotFound, "%s does not exist", req.Path)
+	}
+	if err != nil {
+		s.refuse(conn, hideRoot(err, req.Path, ""))
+		return
+	}
+
+	if err := protocol.WriteMessage(conn, protocol.Response{Entries: entries}); err != nil {
+		s.Logger.Println(err)
+	}
+}
+
+func (s *Server) list(listPath string, recursive, checksums bool) ([]protocol.Entry, error) {
+	info, err := os.Stat(listPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		entry, err := newEntry(filepath.Dir(listPath), listPath, info, checksums)
+		return []protocol.Entry{entry}, err
+	}
+
+	versionsDir := filepath.Join(s.DestDir, versions.DirName)
+	var entries []protocol.Entry
+	if !recursive {
+		infos, err := ioutil.ReadDir(listPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			path := filepath.Join(listPath, info.Name())
+			if path == versionsDir {
+				continue
+			}
+			entry, err := newEntry(listPath, path, info, checksums)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	}
+
+	err = filepath.Walk(listPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == versionsDir {
+			return filepath.SkipDir
+		}
+		if path == listPath {
+			return nil
+		}
+		entry, err := newEntry(listPath, path, info, checksums)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func newEntry(basePath, path string, info os.FileInfo, checksum bool) (protocol.Entry, error) {
+	relPath, err := filepath.Rel(basePath, path)
+	if err != nil {
+		return protocol.Entry{}, err
+	}
+
+	entry := protocol.Entry{
+		Path:    filepath.ToSlash(relPath),
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+	if checksum && info.Mode().IsRegular() {
+		if entry.MD5, err = tarstream.Checksum(path); err != nil {
+			return protocol.Entry{}, err
+		}
+	}
+	return entry, nil
+}
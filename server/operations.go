@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net"
+	"os"
+
+	"github.com/craigfurman/ezxfer/protocol"
+)
+
+func (s *Server) handleRemove(conn net.Conn, req protocol.Request) {
+	s.handleOperation(conn, req, s.Permissions.Delete, func() error {
+		filePath, err := s.resolveExisting(req.Path)
+		if err != nil {
+			return err
+		}
+		size, err := s.quotaSize(filePath)
+		if err != nil {
+			return err
+		}
+		if req.Recursive {
+			err = os.RemoveAll(filePath)
+		} else {
+			err = os.Remove(filePath)
+		}
+		if err != nil {
+			return err
+		}
+		s.treeChanged(filePath, "", size)
+		return nil
+	})
+}
+
+func (s *Server) handleMove(conn net.Conn, req protocol.Request) {
+	s.handleOperation(conn, req, s.Permissions.Move, func() error {
+		from, err := s.resolveExisting(req.Path)
+		if err != nil {
+			return err
+		}
+		to, err := s.resolve(req.To)
+		if err != nil {
+			return err
+		}
+		if to == s.DestDir {
+			return errorf(protocol.CodeInvalidPath, "cannot replace the server root")
+		}
+		if _, err := os.Lstat(to); err == nil {
+			return errorf(protocol.CodeConflict, "%s already exists", req.To)
+		}
+		size, err := s.quotaSize(from)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		s.treeChanged(from, to, size)
+		return nil
+	})
+}
+
+func (s *Server) handleMkdir(conn net.Conn, req protocol.Request) {
+	s.handleOperation(conn, req, s.Permissions.Mkdir, func() error {
+		dirPath, err := s.resolve(req.Path)
+		if err != nil {
+			return err
+		}
+		return os.MkdirAll(dirPath, 0755)
+	})
+}
+
+// handleOperation performs an operation that changes files on the server if
+// it is allowed, recording the outcome in the audit log.
+func (s *Server) handleOperation(conn net.Conn, req protocol.Request, allowed bool, operation func() error) {
+	var err error
+	if allowed {
+		err = hideRoot(operation(), req.Path, req.To)
+	} else {
+		err = errorf(protocol.CodePermissionDenied, "%s is not allowed", req.Op)
+	}
+
+	var resp protocol.Response
+	outcome := "ok"
+	if err != nil {
+		resp.Error = err.Error()
+		resp.Code = errorCode(err)
+		outcome = resp.Error
+	}
+	s.Logger.Printf("audit: client=%s op=%s path=%q to=%q result=%q", conn.RemoteAddr(), req.Op, req.Path, req.To, outcome)
+
+	if err := protocol.WriteMessage(conn, resp); err != nil {
+		s.Logger.Println(err)
+	}
+}
+
+// resolveExisting resolves a path that must exist and must not be the server
+// root itself.
+func (s *Server) resolveExisting(relPath string) (string, error) {
+	filePath, err := s.resolve(relPath)
+	if err != nil {
+		return "", err
+	}
+	if filePath == s.DestDir {
+		return "", errorf(protocol.CodeInvalidPath, "cannot change the server root")
+	}
+	if _, err := os.Lstat(filePath); os.IsNotExist(err) {
+		return "", errorf(protocol.CodeNotFound, "%s does not exist", relPath)
+	}
+	return filePath, nil
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/craigfurman/ezxfer/protocol"
+	"github.com/craigfurman/ezxfer/units"
+)
+
+var errFreeSpaceUnknown = errors.New("free space is unknown on this platform")
+
+// Quotas limit how much clients may store. Sends over a quota, or over the
+// free space on DestDir's filesystem, are refused before any file is written,
+// and are aborted if they send more than they announced, or if a file would
+// take a directory over its quota. Sends must announce their size to servers
+// with quotas.
+type Quotas struct {
+	// Clients limits the bytes each client may store while the server runs.
+	// Clients are identified by their token, or by their IP address when the
+	// server does not require tokens.
+	Clients map[string]int64
+	// Dirs limits the total size of directories, by their path relative to
+	// DestDir. Each is measured the first time a file is sent into it, and
+	// is then kept up to date with the files that the server saves, removes
+	// and moves, but not with changes made to it by other means.
+	Dirs map[string]int64
+}
+
+// clientID identifies the client that sent req for Quotas.Clients.
+func (s *Server) clientID(conn net.Conn, req protocol.Request) string {
+	if len(s.Tokens) > 0 {
+		return req.Token
+	}
+	return clientIP(conn.RemoteAddr())
+}
+
+// reservation is the space reserved for a send, which the files it sends are
+// counted against.
+type reservation struct {
+	client   string
+	size     int64
+	received int64
+	// stored is the bytes of the files saved, which stay charged to the
+	// client once the send ends.
+	stored int64
+}
+
+// receive counts a file of size bytes as received, failing if it takes the
+// send over the size it announced. Sends that did not announce a size are
+// only accepted by servers without quotas, and are not counted.
+func (r *reservation) receive(name string, size int64) error {
+	if r.size <= 0 {
+		return nil
+	}
+	if r.received+size > r.size {
+		return errorf(protocol.CodeQuotaExceeded, "%s takes the send over its announced size of %s", name, units.FormatBytes(r.size))
+	}
+	r.received += size
+	return nil
+}
+
+func (q Quotas) any() bool {
+	return len(q.Clients) > 0 || len(q.Dirs) > 0
+}
+
+// reserveSpace checks that size bytes sent by client to destDir fit on the
+// filesystem and within its quotas, and charges them to the client.
+func (s *Server) reserveSpace(client, destDir string, size int64) (*reservation, error) {
+	if size <= 0 {
+		if s.Quotas.any() {
+			return nil, errorf(protocol.CodeInvalidRequest, "sends to this server must announce their size")
+		}
+		return &reservation{}, nil
+	}
+
+	available, err := freeSpace(s.DestDir)
+	if err != nil && err != errFreeSpaceUnknown {
+		return nil, err
+	}
+	if err == nil && size > available {
+		return nil, errorf(protocol.CodeNoSpace, "not enough space: %s to send, %s available", units.FormatBytes(size), units.FormatBytes(available))
+	}
+
+	if err := s.reserveDirs(s.quotaDirs(destDir), size, false); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	quota, ok := s.Quotas.Clients[client]
+	if ok && s.clientUsage[client]+size > quota {
+		return nil, errorf(protocol.CodeQuotaExceeded, "client quota exceeded: %s to send, %s of %s used", units.FormatBytes(size), units.FormatBytes(s.clientUsage[client]), units.FormatBytes(quota))
+	}
+	if s.clientUsage == nil {
+		s.clientUsage = map[string]int64{}
+	}
+	s.clientUsage[client] += size
+	return &reservation{client: client, size: size}, nil
+}
+
+// releaseSpace refunds the client the bytes reserved for a send that were not
+// stored, once it has ended.
+func (s *Server) releaseSpace(r *reservation) {
+	if r.size <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientUsage[r.client] -= r.size - r.stored
+}
+
+// reserveFile checks that a file of size bytes saved at filePath, replacing
+// a file of replaced bytes, fits within the quotas of the directories it is
+// in, and reserves the space for it while it is received. The returned
+// function releases it once the file is saved, charging the directories the
+// difference in size, or once it is not.
+func (s *Server) reserveFile(filePath string, size, replaced int64) (func(saved bool), error) {
+	dirs := s.quotaDirs(filePath)
+	reserved := size - replaced
+	if reserved < 0 {
+		reserved = 0
+	}
+	if err := s.reserveDirs(dirs, reserved, true); err != nil {
+		return nil, err
+	}
+	return func(saved bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, dir := range dirs {
+			s.dirPending[dir] -= reserved
+			if used, ok := s.dirUsage[dir]; ok && saved {
+				s.dirUsage[dir] = used + size - replaced
+			}
+		}
+	}, nil
+}
+
+// treeChanged keeps the sizes of quota directories up to date once the file
+// or directory at from, of size bytes, has been removed, or moved to to if it
+// is set. Quota directories that a tree is moved into are measured again when
+// next needed.
+func (s *Server) treeChanged(from, to string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for dir, used := range s.dirUsage {
+		quotaDir := filepath.Join(s.DestDir, filepath.FromSlash(dir))
+		switch {
+		case to != "" && within(quotaDir, to):
+			delete(s.dirUsage, dir)
+		case within(quotaDir, from):
+			s.dirUsage[dir] = 0
+		default:
+			if within(from, quotaDir) {
+				used -= size
+			}
+			if to != "" && within(to, quotaDir) {
+				used += size
+			}
+			s.dirUsage[dir] = used
+		}
+	}
+}
+
+// quotaSize returns the size of the file or directory at path, for
+// treeChanged, if there are directory quotas to keep up to date.
+func (s *Server) quotaSize(path string) (int64, error) {
+	if len(s.Quotas.Dirs) == 0 {
+		return 0, nil
+	}
+	return dirSize(path)
+}
+
+// quotaDirs returns the directories with quotas that path is in.
+func (s *Server) quotaDirs(path string) []string {
+	var dirs []string
+	for dir := range s.Quotas.Dirs {
+		if within(path, filepath.Join(s.DestDir, filepath.FromSlash(dir))) {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// within reports whether path is dir or is under it.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// reserveDirs checks that size more bytes fit within the quotas of dirs,
+// counting the files stored in them and those being received, and reserves
+// them if reserve is set. Each directory is measured the first time a file is
+// sent into it, before any file is received there, and is then kept up to
+// date with the files that the server saves, removes and moves.
+func (s *Server) reserveDirs(dirs []string, size int64, reserve bool) error {
+	for {
+		s.mu.Lock()
+		unmeasured := ""
+		for _, dir := range dirs {
+			if _, ok := s.dirUsage[dir]; !ok {
+				unmeasured = dir
+				break
+			}
+		}
+		if unmeasured == "" {
+			defer s.mu.Unlock()
+			return s.reserveMeasuredDirs(dirs, size, reserve)
+		}
+		s.mu.Unlock()
+
+		used, err := dirSize(filepath.Join(s.DestDir, filepath.FromSlash(unmeasured)))
+		if err != nil {
+			return hideRoot(err, unmeasured, "")
+		}
+		s.mu.Lock()
+		if s.dirUsage == nil {
+			s.dirUsage = map[string]int64{}
+		}
+		if _, ok := s.dirUsage[unmeasured]; !ok {
+			s.dirUsage[unmeasured] = used
+		}
+		s.mu.Unlock()
+	}
+}
+
+// reserveMeasuredDirs is reserveDirs once every dir is measured. It is called
+// with s.mu held.
+func (s *Server) reserveMeasuredDirs(dirs []string, size int64, reserve bool) error {
+	for _, dir := range dirs {
+		used := s.dirUsage[dir] + s.dirPending[dir]
+		if quota := s.Quotas.Dirs[dir]; used+size > quota {
+			return errorf(protocol.CodeQuotaExceeded, "quota for %s exceeded: %s to send, %s of %s used", dir, units.FormatBytes(size), units.FormatBytes(used), units.FormatBytes(quota))
+		}
+	}
+	if !reserve {
+		return nil
+	}
+	if s.dirPending == nil {
+		s.dirPending = map[string]int64{}
+	}
+	for _, dir := range dirs {
+		s.dirPending[dir] += size
+	}
+	return nil
+}
+
+// dirSize returns the total size of the files under dir, which need not
+// exist.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -2,104 +2,634 @@ package server
 
 import (
 	"archive/tar"
+	"bufio"
 	"context"
-	"crypto/md5"
-	"encoding/hex"
+	"crypto/subtle"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/craigfurman/ezxfer/protocol"
+	"github.com/craigfurman/ezxfer/ratelimit"
+	"github.com/craigfurman/ezxfer/tarstream"
+	"github.com/craigfurman/ezxfer/versions"
 )
 
 type Server struct {
-	Port    int
-	DestDir string
-	Logger  *log.Logger
+	Port        int
+	DestDir     string
+	Logger      *log.Logger
+	Permissions Permissions
+
+	// ConflictPolicy is applied to existing files when the client does not
+	// ask for a policy. Files are overwritten if it is empty.
+	ConflictPolicy protocol.ConflictPolicy
+	// MaxConflictPolicy, if set, is the most destructive policy a client may
+	// ask for. More destructive requests are capped to it.
+	MaxConflictPolicy protocol.ConflictPolicy
+
+	// Versions, if set, keeps a copy of files before they are overwritten.
+	Versions *versions.Store
+
+	// Tokens, if any are set, are the tokens clients must present.
+	Tokens []string
+	// TLSConfig, if set, makes the server accept TLS connections only.
+	TLSConfig *tls.Config
+
+	// ShutdownGracePeriod is how long in-flight transfers are given to finish
+	// once the server is cancelled, before they are aborted.
+	ShutdownGracePeriod time.Duration
+
+	// MaxTransfers, if set, limits the number of gets and puts in progress.
+	MaxTransfers int
+	// MaxTransfersPerIP, if set, limits the transfers in progress per client
+	// IP address.
+	MaxTransfersPerIP int
+	// QueueWhenBusy makes transfers over the limits wait for a slot, rather
+	// than being refused.
+	QueueWhenBusy bool
+	// RetryAfter is how long refused clients are asked to wait before trying
+	// again. It is 5 seconds if unset.
+	RetryAfter time.Duration
+
+	// Limiter, if set, limits the bandwidth of all transfers together.
+	Limiter *ratelimit.Limiter
+	// ConnectionLimiter, if set, limits the bandwidth of each transfer. It is
+	// split for each connection, which then shares its rate but not its
+	// bucket.
+	ConnectionLimiter *ratelimit.Limiter
+
+	Quotas Quotas
+
+	// Durability decides when received files are synced to disk. Nothing is
+	// synced if it is empty.
+	Durability Durability
+
+	// StreamTimeout is how long each stream of a send over several
+	// connections waits for the others to finish while none of them
+	// receives anything. It is a minute if unset.
+	StreamTimeout time.Duration
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	active   sync.WaitGroup
+	stopping bool
+	// stopped is closed once stopping is set.
+	stopped chan struct{}
+	slots   transferSlots
+	// clientUsage is the bytes each client has sent, for Quotas.Clients.
+	clientUsage map[string]int64
+	// dirUsage is the measured size of each directory in Quotas.Dirs, and
+	// dirPending the bytes reserved for files being received into it.
+	dirUsage   map[string]int64
+	dirPending map[string]int64
+	// transfers are the sends over several connections in progress.
+	transfers map[string]*transfer
+	// stripes are the single files being sent over several connections.
+	stripes map[string]*stripedFile
+	// syncPath, if set, replaces fsyncPath.
+	syncPath func(path string) error
 }
 
-type acceptedConnection struct {
-	conn net.Conn
-	err  error
+// Permissions controls which operations clients may perform. Everything is
+// denied by default.
+type Permissions struct {
+	// Read allows clients to fetch and list files.
+	Read bool
+	// Write allows clients to send files.
+	Write bool
+	// Delete allows clients to remove files and directories.
+	Delete bool
+	// Move allows clients to move files and directories.
+	Move bool
+	// Mkdir allows clients to create directories.
+	Mkdir bool
 }
 
 func (s *Server) ServeTCP(ctx context.Context) error {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
+	return s.ListenAndServe(ctx, fmt.Sprintf(":%d", s.Port))
+}
+
+// ListenAndServe listens on address and serves connections on it, as Serve
+// does.
+func (s *Server) ListenAndServe(ctx context.Context, address string) error {
+	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve serves connections on listener until ctx is cancelled, then drains
+// in-flight connections before returning. It closes listener, and can be
+// called more than once to serve on several listeners.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	if s.TLSConfig != nil {
+		listener = tls.NewListener(listener, s.TLSConfig)
+	}
 	defer listener.Close()
+	s.Logger.Printf("serving %s on %s", s.DestDir, listener.Addr())
 
-	connChan := make(chan acceptedConnection)
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-stopped:
+		}
+	}()
 
+	var delay time.Duration
 	for {
-		go func() {
-			conn, err := listener.Accept()
-			connChan <- acceptedConnection{conn: conn, err: err}
-		}()
-
-		select {
-		case connection := <-connChan:
-			if connection.err != nil {
-				return connection.err
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				s.drain()
+				return ctx.Err()
 			}
-			go s.receiveFiles(connection.conn)
-		case <-ctx.Done():
-			return ctx.Err()
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				delay = acceptBackoff(delay)
+				s.Logger.Printf("accept error: %s; retrying in %s", err, delay)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			return err
 		}
+		delay = 0
+
+		s.track(conn)
+		go s.serve(conn)
+	}
+}
+
+// acceptBackoff doubles the delay after a temporary accept error, from 5ms up
+// to a second.
+func acceptBackoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		return time.Second
+	}
+	return delay
+}
+
+func (s *Server) track(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.conns[conn] = struct{}{}
+	s.active.Add(1)
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.active.Done()
+	}()
+	s.handle(conn)
+}
+
+// drain waits for in-flight connections to finish, closing any that are still
+// open after ShutdownGracePeriod.
+func (s *Server) drain() {
+	s.stop()
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(s.ShutdownGracePeriod):
+	}
+
+	s.mu.Lock()
+	s.Logger.Printf("aborting %d connections still in progress", len(s.conns))
+	for conn := range s.conns {
+		conn.Close()
 	}
+	s.mu.Unlock()
+	<-done
 }
 
-func (s *Server) receiveFiles(conn net.Conn) {
+func (s *Server) handle(conn net.Conn) {
 	defer conn.Close()
-	tarStream := tar.NewReader(conn)
+	connReader := bufio.NewReader(conn)
+
+	var req protocol.Request
+	if err := protocol.ReadMessage(connReader, &req); err != nil {
+		s.Logger.Println(err)
+		return
+	}
+
+	if !s.authorized(req.Token) {
+		s.refuse(conn, errorf(protocol.CodeUnauthorized, "invalid token"))
+		return
+	}
+
+	switch req.Op {
+	case protocol.OpPut, protocol.OpGet:
+		t, release, err := s.admitTransfer(conn, req)
+		if err != nil {
+			s.refuseBusy(conn, err)
+			return
+		}
+		defer release()
+		if req.Op == protocol.OpPut {
+			var body io.Reader = connReader
+			if t != nil {
+				body = &activityReader{r: connReader, t: t}
+			}
+			s.handlePut(conn, body, req)
+		} else {
+			s.handleGet(conn, req)
+		}
+	case protocol.OpList:
+		s.handleList(conn, req)
+	case protocol.OpRemove:
+		s.handleRemove(conn, req)
+	case protocol.OpMove:
+		s.handleMove(conn, req)
+	case protocol.OpMkdir:
+		s.handleMkdir(conn, req)
+	default:
+		s.refuse(conn, errorf(protocol.CodeInvalidRequest, "unknown operation %q", req.Op))
+	}
+}
+
+func (s *Server) handlePut(conn net.Conn, connReader io.Reader, req protocol.Request) {
+	if !s.Permissions.Write {
+		s.refuse(conn, errorf(protocol.CodePermissionDenied, "write access is not allowed"))
+		return
+	}
+
+	var space *reservation
+	policy, err := s.conflictPolicy(req.ConflictPolicy)
+	if err == nil {
+		var destDir string
+		destDir, err = s.resolve(req.Path)
+		if err == nil {
+			space, err = s.reserveSpace(s.clientID(conn, req), destDir, req.Size)
+		}
+		if err == nil {
+			err = hideRoot(os.MkdirAll(destDir, 0755), req.Path, "")
+		}
+	}
+	if space != nil {
+		defer s.releaseSpace(space)
+	}
+	if err != nil {
+		s.refuse(conn, err)
+		return
+	}
+	if err := protocol.WriteMessage(conn, protocol.Response{ConflictPolicy: policy, Batches: true}); err != nil {
+		s.Logger.Println(err)
+		return
+	}
+
+	s.receiveFiles(conn, connReader, req, policy, space)
+}
+
+func (s *Server) handleGet(conn net.Conn, req protocol.Request) {
+	if !s.Permissions.Read {
+		s.refuse(conn, errorf(protocol.CodePermissionDenied, "read access is not allowed"))
+		return
+	}
+
+	filePath, err := s.resolve(req.Path)
+	if err == nil {
+		if _, statErr := os.Stat(filePath); os.IsNotExist(statErr) {
+			err = errorf(protocol.CodeNotFound, "%s does not exist", req.Path)
+		}
+	}
+	if err != nil {
+		s.refuse(conn, err)
+		return
+	}
+	if err := protocol.WriteMessage(conn, protocol.Response{Results: true}); err != nil {
+		s.Logger.Println(err)
+		return
+	}
+
+	s.Logger.Printf("sending %s", filePath)
+	tarStream := tarstream.NewWriter(ratelimit.NewWriter(conn, s.Limiter, s.ConnectionLimiter.Split()))
+	tarStream.SkipDirs = []string{filepath.Join(s.DestDir, versions.DirName)}
+	_, tarStream.ZeroCopy = conn.(*net.TCPConn)
+	err = tarStream.WriteFiles(filePath)
+	if err != nil {
+		s.Logger.Println(err)
+	}
+	// A stream that ends part way through a file has no trailer, and no
+	// result, which the client reports as a failure.
+	if err := tarStream.Close(); err != nil {
+		s.Logger.Println(err)
+		return
+	}
+
+	var result protocol.Result
+	if err != nil {
+		name := req.Path
+		if pathErr, ok := err.(*os.PathError); ok {
+			if rel, relErr := filepath.Rel(s.DestDir, pathErr.Path); relErr == nil {
+				name = filepath.ToSlash(rel)
+			}
+		}
+		err = hideRoot(err, name, "")
+		result.Error, result.Code = err.Error(), errorCode(err)
+	}
+	if err := protocol.WriteMessage(conn, result); err != nil {
+		s.Logger.Println(err)
+	}
+}
+
+func (s *Server) authorized(token string) bool {
+	if len(s.Tokens) == 0 {
+		return true
+	}
+	for _, valid := range s.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// refuse replies to a request with an error.
+func (s *Server) refuse(conn net.Conn, err error) {
+	s.Logger.Println(err)
+	if err := protocol.WriteMessage(conn, protocol.Response{Error: err.Error(), Code: errorCode(err)}); err != nil {
+		s.Logger.Println(err)
+	}
+}
+
+func (s *Server) conflictPolicy(requested protocol.ConflictPolicy) (protocol.ConflictPolicy, error) {
+	policy := requested
+	if policy == "" {
+		policy = s.ConflictPolicy
+	}
+	if policy == "" {
+		policy = protocol.ConflictOverwrite
+	}
+	if _, err := protocol.ParseConflictPolicy(string(policy)); err != nil {
+		return "", errorf(protocol.CodeInvalidRequest, "%s", err)
+	}
+
+	if s.MaxConflictPolicy != "" {
+		policy = policy.Cap(s.MaxConflictPolicy)
+	}
+	return policy, nil
+}
+
+// resolve returns the absolute path of relPath under DestDir, refusing paths
+// that escape it.
+func (s *Server) resolve(relPath string) (string, error) {
+	path := filepath.Join(s.DestDir, filepath.FromSlash(relPath))
+	rel, err := filepath.Rel(s.DestDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errorf(protocol.CodeInvalidPath, "path %s is outside of the server root", relPath)
+	}
+	if rel == versions.DirName || strings.HasPrefix(rel, versions.DirName+string(filepath.Separator)) {
+		return "", errorf(protocol.CodeInvalidPath, "path %s is reserved for file versions", relPath)
+	}
+	return path, nil
+}
+
+// receiveFiles saves the files of a put, counting them against the space
+// reserved for it.
+func (s *Server) receiveFiles(conn net.Conn, connReader io.Reader, req protocol.Request, policy protocol.ConflictPolicy, space *reservation) {
+	if req.Stripe != nil {
+		s.receiveStripe(conn, connReader, req, policy, space)
+		return
+	}
+
+	tarStream := tar.NewReader(ratelimit.NewReader(connReader, s.Limiter, s.ConnectionLimiter.Split()))
+	var result protocol.Result
+	syncer := s.newSyncer()
+
+	// receive saves a file with save, unless the conflict policy skips it,
+	// and records what was done with it.
+	receive := func(header *tar.Header, save func(filePath string) error) error {
+		if req.Rename != "" && len(result.Files) > 0 {
+			return errorf(protocol.CodeInvalidRequest, "only a single file can be renamed on arrival")
+		}
+		if err := space.receive(header.Name, header.Size); err != nil {
+			return err
+		}
+
+		filePath, fileResult, release, err := s.prepareFile(req, header, header.Size, policy)
+		if err != nil {
+			return err
+		}
+		result.Files = append(result.Files, fileResult)
+		if fileResult.Action == protocol.ActionSkipped {
+			s.Logger.Printf("skipping existing file %s", filePath)
+			return nil
+		}
+
+		s.Logger.Printf("saving file to %s", filePath)
+		if err := save(filePath); err != nil {
+			if _, ok := err.(*tarstream.ChecksumError); !ok {
+				s.removePartial(filePath)
+			}
+			release(false)
+			return hideRoot(err, header.Name, "")
+		}
+		release(true)
+		space.stored += header.Size
+		if err := syncer.add(filePath); err != nil {
+			return withPrefix("error syncing "+header.Name, hideRoot(err, header.Name, ""))
+		}
+		return nil
+	}
 
 	for {
 		header, err := tarStream.Next()
 		if err != nil {
 			if err != io.EOF {
-				s.Logger.Println(err)
+				s.replyError(conn, connReader, req, result, errorf(protocol.CodeInvalidRequest, "error reading tar stream: %s", err))
 				return
 			}
 			break
 		}
 
-		filePath := filepath.Join(s.DestDir, header.Name)
-		if err = os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-			s.Logger.Println(err)
-			return
+		if tarstream.IsBatch(header) {
+			err = tarstream.ReceiveBatch(tarStream, header, func(fileHeader *tar.Header, content io.Reader) error {
+				return receive(fileHeader, func(filePath string) error {
+					return tarstream.SaveFile(content, fileHeader, filePath)
+				})
+			})
+			if _, ok := err.(*tarstream.ChecksumError); ok {
+				err = withPrefix(fmt.Sprintf("batch of %s files", header.Xattrs[tarstream.BatchAttributeKey]), err)
+			}
+		} else {
+			err = receive(header, func(filePath string) error {
+				return tarstream.ReceiveFile(tarStream, header, filePath)
+			})
 		}
-
-		s.Logger.Printf("saving file to %s", filePath)
-		file, err := os.Create(filePath)
 		if err != nil {
-			s.Logger.Println(err)
+			s.replyError(conn, connReader, req, result, err)
 			return
 		}
-		defer file.Close()
+	}
+	if err := syncer.flush(); err != nil {
+		s.replyError(conn, connReader, req, result, withPrefix("error syncing files", hideRoot(err, req.Path, "")))
+		return
+	}
 
-		checksumWriter := md5.New()
-		fileAndChecksum := io.MultiWriter(file, checksumWriter)
+	s.writeResult(conn, req, result)
+}
+
+// writeResult replies to a put with its result, combined with those of the
+// other streams of the transfer, if any.
+func (s *Server) writeResult(conn net.Conn, req protocol.Request, result protocol.Result) {
+	result = s.combineResult(s.transferKey(conn, req), req, result)
+	if err := protocol.WriteMessage(conn, result); err != nil {
+		s.Logger.Println(err)
+	}
+}
+
+// prepareFile decides where a file of size bytes received with header is
+// saved, according to the request and the conflict policy, reserves space for
+// it within the quotas of its directories, and stashes the existing file if
+// it is to be overwritten. The returned function releases the reservation
+// once the file is saved, and keeps the stashed file as a version, or, if the
+// file is not saved, puts the stashed file back over whatever was received.
+func (s *Server) prepareFile(req protocol.Request, header *tar.Header, size int64, policy protocol.ConflictPolicy) (string, protocol.FileResult, func(saved bool), error) {
+	name := header.Name
+	if req.Rename != "" {
+		name = req.Rename
+	}
+
+	filePath, err := s.resolve(filepath.Join(req.Path, name))
+	if err != nil {
+		return "", protocol.FileResult{}, nil, err
+	}
+	filePath, action, err := resolveConflict(filePath, header, policy)
+	if err != nil {
+		return "", protocol.FileResult{}, nil, withPrefix(name, hideRoot(err, name, ""))
+	}
+	fileResult := protocol.FileResult{Path: header.Name, Action: action}
+	if savedAs, err := filepath.Rel(filepath.Join(s.DestDir, req.Path), filePath); err == nil && filepath.ToSlash(savedAs) != header.Name {
+		fileResult.SavedAs = filepath.ToSlash(savedAs)
+	}
+	if action == protocol.ActionSkipped {
+		return filePath, fileResult, func(bool) {}, nil
+	}
 
-		if _, err := io.Copy(fileAndChecksum, tarStream); err != nil {
+	var replaced int64
+	if action == protocol.ActionOverwritten {
+		if existing, err := os.Stat(filePath); err == nil {
+			replaced = existing.Size()
+		}
+	}
+	release, err := s.reserveFile(filePath, size, replaced)
+	if err != nil {
+		return "", protocol.FileResult{}, nil, withPrefix(name, err)
+	}
+	if action != protocol.ActionOverwritten || s.Versions == nil {
+		return filePath, fileResult, release, nil
+	}
+	settle, err := s.stash(filePath)
+	if err != nil {
+		release(false)
+		return "", protocol.FileResult{}, nil, withPrefix("error backing up "+name, hideRoot(err, name, ""))
+	}
+	return filePath, fileResult, func(saved bool) {
+		if err := settle(saved); err != nil {
 			s.Logger.Println(err)
-			return
 		}
+		release(saved)
+	}, nil
+}
 
-		md5Sum := hex.EncodeToString(checksumWriter.Sum(nil))
-		expectedMd5Sum := header.Xattrs["md5"]
-		if md5Sum != expectedMd5Sum {
-			msg := fmt.Sprintf("md5 does not match: expected %s, got %s", expectedMd5Sum, md5Sum)
-			s.Logger.Println(msg)
-			if _, err := conn.Write([]byte(msg)); err != nil {
-				s.Logger.Println(err)
-			}
-			return
+// resolveConflict decides, according to policy, whether and where a received
+// file is saved when filePath already exists.
+func resolveConflict(filePath string, header *tar.Header, policy protocol.ConflictPolicy) (string, protocol.Action, error) {
+	existing, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return filePath, protocol.ActionCreated, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	switch policy {
+	case protocol.ConflictFail:
+		return "", "", errorf(protocol.CodeConflict, "file already exists")
+	case protocol.ConflictSkip:
+		return filePath, protocol.ActionSkipped, nil
+	case protocol.ConflictRename:
+		return numberedPath(filePath), protocol.ActionRenamed, nil
+	case protocol.ConflictOverwriteIfNewer:
+		if !header.ModTime.After(existing.ModTime()) {
+			return filePath, protocol.ActionSkipped, nil
+		}
+	}
+	return filePath, protocol.ActionOverwritten, nil
+}
+
+// stash moves the file at filePath into the versions directory while the
+// file replacing it is received. See versions.Store.Stash.
+func (s *Server) stash(filePath string) (func(saved bool) error, error) {
+	relPath, err := filepath.Rel(s.DestDir, filePath)
+	if err != nil {
+		return nil, err
+	}
+	s.Logger.Printf("backing up previous version of %s", filePath)
+	return s.Versions.Stash(relPath)
+}
+
+// numberedPath returns the first of name.1.ext, name.2.ext, ... that does not
+// exist.
+func numberedPath(filePath string) string {
+	ext := filepath.Ext(filePath)
+	if ext == filepath.Base(filePath) {
+		ext = ""
+	}
+	base := strings.TrimSuffix(filePath, ext)
+
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.%d%s", base, i, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
 		}
 	}
+}
+
+// replyError discards the rest of the client's stream before replying, so that
+// the reply is not lost to a connection reset.
+func (s *Server) replyError(conn net.Conn, connReader io.Reader, req protocol.Request, result protocol.Result, err error) {
+	s.Logger.Println(err)
+	if _, err := io.Copy(ioutil.Discard, connReader); err != nil {
+		s.Logger.Println(err)
+	}
+	result.Error = err.Error()
+	result.Code = errorCode(err)
+	s.writeResult(conn, req, result)
+}
 
-	if _, err := conn.Write([]byte("OK")); err != nil {
+func (s *Server) removePartial(filePath string) {
+	s.Logger.Printf("removing partially received file %s", filePath)
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
 		s.Logger.Println(err)
 	}
 }
@@ -2,20 +2,33 @@ package server_test
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/md5"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/craigfurman/ezxfer/client"
+	"github.com/craigfurman/ezxfer/protocol"
+	"github.com/craigfurman/ezxfer/ratelimit"
 	"github.com/craigfurman/ezxfer/server"
+	"github.com/craigfurman/ezxfer/tarstream"
 	"github.com/craigfurman/ezxfer/testhelpers"
+	"github.com/craigfurman/ezxfer/versions"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 )
 
 var _ = Describe("receiving files", func() {
@@ -42,7 +55,16 @@ var _ = Describe("receiving files", func() {
 		destDir := filepath.Join(tempDir, "dest")
 		Expect(os.Mkdir(destDir, 0755)).To(Succeed())
 
-		s = &server.Server{Port: port, DestDir: destDir, Logger: log.New(GinkgoWriter, "[ezxfer server unit tests] ", log.LstdFlags)}
+		s = &server.Server{
+			Port:        port,
+			DestDir:     destDir,
+			Logger:      log.New(GinkgoWriter, "[ezxfer server unit tests] ", log.LstdFlags),
+			Permissions: server.Permissions{Write: true},
+		}
+	})
+
+	// The server is started once each spec has configured it.
+	JustBeforeEach(func() {
 		serverResult = make(chan error)
 		go func() {
 			serverResult <- s.ServeTCP(ctx)
@@ -61,44 +83,1342 @@ var _ = Describe("receiving files", func() {
 		}).Should(HaveOccurred())
 	})
 
-	testServer := func(md5FromClient, expectedResponse string) {
+	sendRequest := func(req protocol.Request) (net.Conn, *bufio.Reader, protocol.Response) {
+		if req.Op == "" {
+			req.Op = protocol.OpPut
+		}
 		conn, err := net.Dial("tcp", address)
 		Expect(err).NotTo(HaveOccurred())
-		defer conn.Close()
+		connReader := bufio.NewReader(conn)
 
-		fileName := "a-file.txt"
-		content := "some content\n"
-		Expect(testhelpers.CreateFile(content, tempDir, "src", fileName)).To(Succeed())
-		srcFileInfo, err := os.Stat(filepath.Join(tempDir, "src", fileName))
+		Expect(protocol.WriteMessage(conn, req)).To(Succeed())
+		var resp protocol.Response
+		Expect(protocol.ReadMessage(connReader, &resp)).To(Succeed())
+		return conn, connReader, resp
+	}
+
+	writeFile := func(tarWriter *tar.Writer, fileName, content, md5 string) {
+		srcFile := filepath.Join(tempDir, "src", filepath.Base(fileName))
+		Expect(testhelpers.CreateFile(content, srcFile)).To(Succeed())
+		srcFileInfo, err := os.Stat(srcFile)
 		Expect(err).NotTo(HaveOccurred())
 
-		tarWriter := tar.NewWriter(conn)
 		header, err := tar.FileInfoHeader(srcFileInfo, "")
 		Expect(err).NotTo(HaveOccurred())
-		header.Xattrs = map[string]string{client.MD5_ATTRIBUTE_KEY: md5FromClient}
+		header.Name = fileName
+		header.Xattrs = map[string]string{client.MD5_ATTRIBUTE_KEY: md5}
 		Expect(tarWriter.WriteHeader(header)).To(Succeed())
 		_, err = tarWriter.Write([]byte(content))
 		Expect(err).NotTo(HaveOccurred())
+	}
+
+	sendFiles := func(req protocol.Request, md5 string, fileNames ...string) protocol.Result {
+		conn, connReader, resp := sendRequest(req)
+		defer conn.Close()
+		Expect(resp.Error).To(BeEmpty())
+
+		tarWriter := tar.NewWriter(conn)
+		for _, fileName := range fileNames {
+			writeFile(tarWriter, fileName, "some content\n", md5)
+		}
 		Expect(tarWriter.Close()).To(Succeed())
+		Expect(conn.(*net.TCPConn).CloseWrite()).To(Succeed())
 
-		transferredFilePath := filepath.Join(tempDir, "dest", fileName)
-		Eventually(func() error {
-			_, err := os.Stat(transferredFilePath)
-			return err
-		}).ShouldNot(HaveOccurred())
+		var result protocol.Result
+		Expect(protocol.ReadMessage(connReader, &result)).To(Succeed())
+		return result
+	}
 
-		Expect(ioutil.ReadFile(transferredFilePath)).To(Equal([]byte(content)))
+	const contentMd5 = "eb9c2bf0eb63f3a7bc0ea37ef18aeba5"
 
-		Expect(ioutil.ReadAll(conn)).To(Equal([]byte(expectedResponse)))
+	testServer := func(md5FromClient, expectedError string) {
+		fileName := "a-file.txt"
+		result := sendFiles(protocol.Request{}, md5FromClient, fileName)
+		Expect(result.Error).To(Equal(expectedError))
+		Expect(result.Files).To(Equal([]protocol.FileResult{{Path: fileName, Action: protocol.ActionCreated}}))
+		Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", fileName))).To(Equal([]byte("some content\n")))
 	}
 
 	It("writes the tar stream to the destination directory and confirms that checksum matches", func() {
-		testServer("eb9c2bf0eb63f3a7bc0ea37ef18aeba5", "OK")
+		testServer(contentMd5, "")
 	})
 
 	Context("when the md5 does not match", func() {
 		It("replies with an error", func() {
 			testServer("wrong", "md5 does not match: expected wrong, got eb9c2bf0eb63f3a7bc0ea37ef18aeba5")
 		})
+
+		It("reports a checksum error code", func() {
+			Expect(sendFiles(protocol.Request{}, "wrong", "a-file.txt").Code).To(Equal(protocol.CodeChecksum))
+		})
+	})
+
+	Context("when small files are sent in a batch", func() {
+		sendBatch := func(corrupt bool) protocol.Result {
+			conn, connReader, resp := sendRequest(protocol.Request{Path: "incoming"})
+			defer conn.Close()
+			Expect(resp.Batches).To(BeTrue())
+
+			var batch bytes.Buffer
+			batchWriter := tar.NewWriter(&batch)
+			for _, fileName := range []string{"a.txt", "d1/b.txt"} {
+				Expect(batchWriter.WriteHeader(&tar.Header{Name: fileName, Mode: 0644, Size: 13})).To(Succeed())
+				_, err := batchWriter.Write([]byte("some content\n"))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(batchWriter.Close()).To(Succeed())
+			checksum := fmt.Sprintf("%x", md5.Sum(batch.Bytes()))
+			if corrupt {
+				checksum = "wrong"
+			}
+
+			tarWriter := tar.NewWriter(conn)
+			Expect(tarWriter.WriteHeader(&tar.Header{
+				Name: ".batch",
+				Mode: 0644,
+				Size: int64(batch.Len()),
+				Xattrs: map[string]string{
+					tarstream.MD5AttributeKey:   checksum,
+					tarstream.BatchAttributeKey: "2",
+				},
+			})).To(Succeed())
+			_, err := tarWriter.Write(batch.Bytes())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tarWriter.Close()).To(Succeed())
+			Expect(conn.(*net.TCPConn).CloseWrite()).To(Succeed())
+
+			var result protocol.Result
+			Expect(protocol.ReadMessage(connReader, &result)).To(Succeed())
+			return result
+		}
+
+		It("saves each file in the batch and reports it", func() {
+			result := sendBatch(false)
+			Expect(result.Error).To(BeEmpty())
+			Expect(result.Files).To(Equal([]protocol.FileResult{
+				{Path: "a.txt", Action: protocol.ActionCreated},
+				{Path: "d1/b.txt", Action: protocol.ActionCreated},
+			}))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", "incoming", "d1", "b.txt"))).To(Equal([]byte("some content\n")))
+		})
+
+		It("saves none of the files of a batch that does not match its checksum", func() {
+			Expect(testhelpers.CreateFile("original", tempDir, "dest", "incoming", "a.txt")).To(Succeed())
+
+			result := sendBatch(true)
+			Expect(result.Code).To(Equal(protocol.CodeChecksum))
+			Expect(result.Error).To(HavePrefix("batch of 2 files: md5 does not match: expected wrong"))
+			Expect(result.Files).To(BeEmpty())
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", "incoming", "a.txt"))).To(Equal([]byte("original")))
+			Expect(filepath.Join(tempDir, "dest", "incoming", "d1", "b.txt")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Context("when the client asks for a remote path", func() {
+		It("creates the path under the destination directory and writes files there", func() {
+			Expect(sendFiles(protocol.Request{Path: "/incoming/build-42"}, contentMd5, "a-file.txt").Error).To(BeEmpty())
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", "incoming", "build-42", "a-file.txt"))).To(Equal([]byte("some content\n")))
+		})
+
+		It("refuses paths outside of the destination directory", func() {
+			conn, _, resp := sendRequest(protocol.Request{Path: "../../elsewhere"})
+			defer conn.Close()
+			Expect(resp.Error).To(Equal("path ../../elsewhere is outside of the server root"))
+			Expect(resp.Code).To(Equal(protocol.CodeInvalidPath))
+			Expect(filepath.Join(tempDir, "elsewhere")).NotTo(BeADirectory())
+		})
+	})
+
+	Context("when the tar stream contains paths outside of the destination directory", func() {
+		It("replies with an error", func() {
+			result := sendFiles(protocol.Request{}, contentMd5, "../escaped.txt")
+			Expect(result.Error).To(Equal("path ../escaped.txt is outside of the server root"))
+			Expect(filepath.Join(tempDir, "escaped.txt")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Context("when the client asks for the file to be renamed", func() {
+		It("saves the file under the new name", func() {
+			result := sendFiles(protocol.Request{Path: "incoming", Rename: "renamed.txt"}, contentMd5, "a-file.txt")
+			Expect(result.Error).To(BeEmpty())
+			Expect(result.Files).To(Equal([]protocol.FileResult{{Path: "a-file.txt", Action: protocol.ActionCreated, SavedAs: "renamed.txt"}}))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", "incoming", "renamed.txt"))).To(Equal([]byte("some content\n")))
+			Expect(filepath.Join(tempDir, "dest", "incoming", "a-file.txt")).NotTo(BeAnExistingFile())
+		})
+
+		It("refuses to rename more than one file", func() {
+			result := sendFiles(protocol.Request{Rename: "renamed.txt"}, contentMd5, "a.txt", "b.txt")
+			Expect(result.Error).To(Equal("only a single file can be renamed on arrival"))
+		})
+	})
+
+	Context("when a received file already exists", func() {
+		var existingFile string
+
+		BeforeEach(func() {
+			existingFile = filepath.Join(tempDir, "dest", "a-file.txt")
+			Expect(testhelpers.CreateFile("existing content", existingFile)).To(Succeed())
+		})
+
+		sendWithPolicy := func(policy protocol.ConflictPolicy) protocol.Result {
+			return sendFiles(protocol.Request{ConflictPolicy: policy}, contentMd5, "a-file.txt")
+		}
+
+		It("overwrites it by default", func() {
+			result := sendWithPolicy("")
+			Expect(result.Files).To(Equal([]protocol.FileResult{{Path: "a-file.txt", Action: protocol.ActionOverwritten}}))
+			Expect(ioutil.ReadFile(existingFile)).To(Equal([]byte("some content\n")))
+		})
+
+		It("fails when asked to", func() {
+			result := sendWithPolicy(protocol.ConflictFail)
+			Expect(result.Error).To(Equal("a-file.txt: file already exists"))
+			Expect(result.Code).To(Equal(protocol.CodeConflict))
+			Expect(ioutil.ReadFile(existingFile)).To(Equal([]byte("existing content")))
+		})
+
+		It("skips the file when asked to", func() {
+			result := sendWithPolicy(protocol.ConflictSkip)
+			Expect(result.Error).To(BeEmpty())
+			Expect(result.Files).To(Equal([]protocol.FileResult{{Path: "a-file.txt", Action: protocol.ActionSkipped}}))
+			Expect(ioutil.ReadFile(existingFile)).To(Equal([]byte("existing content")))
+		})
+
+		It("saves the file with a numbered suffix when asked to", func() {
+			Expect(testhelpers.CreateFile("existing content", tempDir, "dest", "a-file.1.txt")).To(Succeed())
+			result := sendWithPolicy(protocol.ConflictRename)
+			Expect(result.Files).To(Equal([]protocol.FileResult{{Path: "a-file.txt", Action: protocol.ActionRenamed, SavedAs: "a-file.2.txt"}}))
+			Expect(ioutil.ReadFile(existingFile)).To(Equal([]byte("existing content")))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", "a-file.2.txt"))).To(Equal([]byte("some content\n")))
+		})
+
+		Context("when asked to overwrite only if newer", func() {
+			It("overwrites files older than the one sent", func() {
+				Expect(os.Chtimes(existingFile, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))).To(Succeed())
+				result := sendWithPolicy(protocol.ConflictOverwriteIfNewer)
+				Expect(result.Files).To(Equal([]protocol.FileResult{{Path: "a-file.txt", Action: protocol.ActionOverwritten}}))
+				Expect(ioutil.ReadFile(existingFile)).To(Equal([]byte("some content\n")))
+			})
+
+			It("skips files newer than the one sent", func() {
+				Expect(os.Chtimes(existingFile, time.Now().Add(time.Hour), time.Now().Add(time.Hour))).To(Succeed())
+				result := sendWithPolicy(protocol.ConflictOverwriteIfNewer)
+				Expect(result.Files).To(Equal([]protocol.FileResult{{Path: "a-file.txt", Action: protocol.ActionSkipped}}))
+				Expect(ioutil.ReadFile(existingFile)).To(Equal([]byte("existing content")))
+			})
+		})
+
+		Context("when the server caps the conflict policy", func() {
+			BeforeEach(func() {
+				s.MaxConflictPolicy = protocol.ConflictSkip
+			})
+
+			It("applies the cap to more destructive requests", func() {
+				conn, _, resp := sendRequest(protocol.Request{ConflictPolicy: protocol.ConflictOverwrite})
+				defer conn.Close()
+				Expect(resp.ConflictPolicy).To(Equal(protocol.ConflictSkip))
+			})
+		})
+
+		Context("when the server keeps versions of overwritten files", func() {
+			BeforeEach(func() {
+				s.Versions = &versions.Store{Root: filepath.Join(tempDir, "dest")}
+			})
+
+			It("backs up the existing file before overwriting it", func() {
+				result := sendWithPolicy(protocol.ConflictOverwrite)
+				Expect(result.Error).To(BeEmpty())
+				Expect(ioutil.ReadFile(existingFile)).To(Equal([]byte("some content\n")))
+
+				found, err := s.Versions.List("a-file.txt")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(found).To(HaveLen(1))
+				Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", versions.DirName, "a-file.txt", found[0].ID))).To(Equal([]byte("existing content")))
+			})
+
+			It("keeps the existing file in place if the new one does not match its checksum", func() {
+				result := sendFiles(protocol.Request{}, "wrong", "a-file.txt")
+				Expect(result.Code).To(Equal(protocol.CodeChecksum))
+				Expect(ioutil.ReadFile(existingFile)).To(Equal([]byte("existing content")))
+				Expect(s.Versions.List("a-file.txt")).To(BeEmpty())
+			})
+
+			It("keeps the existing file in place if the new one is not received in full", func() {
+				conn, _, resp := sendRequest(protocol.Request{})
+				Expect(resp.Error).To(BeEmpty())
+				tarWriter := tar.NewWriter(conn)
+				Expect(tarWriter.WriteHeader(&tar.Header{Name: "a-file.txt", Mode: 0644, Size: 13})).To(Succeed())
+				_, err := tarWriter.Write([]byte("some "))
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(func() ([]versions.Version, error) {
+					return s.Versions.List("a-file.txt")
+				}).Should(HaveLen(1))
+				conn.Close()
+
+				Eventually(func() ([]byte, error) {
+					return ioutil.ReadFile(existingFile)
+				}).Should(Equal([]byte("existing content")))
+				Eventually(func() ([]versions.Version, error) {
+					return s.Versions.List("a-file.txt")
+				}).Should(BeEmpty())
+			})
+		})
+
+		Context("when the server has a default conflict policy", func() {
+			BeforeEach(func() {
+				s.ConflictPolicy = protocol.ConflictRename
+			})
+
+			It("applies it when the client does not ask for a policy", func() {
+				result := sendWithPolicy("")
+				Expect(result.Files).To(Equal([]protocol.FileResult{{Path: "a-file.txt", Action: protocol.ActionRenamed, SavedAs: "a-file.1.txt"}}))
+			})
+		})
+	})
+
+	It("preserves the modification time of received files", func() {
+		Expect(sendFiles(protocol.Request{}, contentMd5, "a-file.txt").Error).To(BeEmpty())
+		src, err := os.Stat(filepath.Join(tempDir, "src", "a-file.txt"))
+		Expect(err).NotTo(HaveOccurred())
+		dst, err := os.Stat(filepath.Join(tempDir, "dest", "a-file.txt"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dst.ModTime()).To(BeTemporally("~", src.ModTime(), time.Second))
+	})
+
+	It("refuses to write into the versions directory", func() {
+		conn, _, resp := sendRequest(protocol.Request{Path: versions.DirName})
+		defer conn.Close()
+		Expect(resp.Error).To(Equal("path .ezxfer-versions is reserved for file versions"))
+	})
+
+	It("refuses unknown conflict policies", func() {
+		conn, _, resp := sendRequest(protocol.Request{ConflictPolicy: "explode"})
+		defer conn.Close()
+		Expect(resp.Error).To(ContainSubstring(`unknown conflict policy "explode"`))
+	})
+
+	It("refuses unknown operations", func() {
+		conn, _, resp := sendRequest(protocol.Request{Op: "explode"})
+		defer conn.Close()
+		Expect(resp.Error).To(Equal(`unknown operation "explode"`))
+	})
+
+	Context("when write access is not allowed", func() {
+		BeforeEach(func() {
+			s.Permissions.Write = false
+		})
+
+		It("refuses to receive files", func() {
+			conn, _, resp := sendRequest(protocol.Request{Op: protocol.OpPut})
+			defer conn.Close()
+			Expect(resp.Error).To(Equal("write access is not allowed"))
+			Expect(resp.Code).To(Equal(protocol.CodePermissionDenied))
+		})
+	})
+
+	Context("when a file cannot be written", func() {
+		It("replies with the error, without revealing the server root", func() {
+			Expect(testhelpers.CreateFile("not a directory", tempDir, "dest", "blocker")).To(Succeed())
+			result := sendFiles(protocol.Request{}, contentMd5, "blocker/a-file.txt")
+			Expect(result.Error).To(Equal("blocker/a-file.txt: stat blocker/a-file.txt: not a directory"))
+			Expect(result.Code).To(Equal(protocol.CodeInternal))
+		})
+	})
+
+	Describe("sending files to clients", func() {
+		BeforeEach(func() {
+			s.Permissions.Read = true
+			Expect(testhelpers.CreateFile("content for a.txt", tempDir, "dest", "logs", "a.txt")).To(Succeed())
+			Expect(testhelpers.CreateFile("content for b.txt", tempDir, "dest", "logs", "d1", "b.txt")).To(Succeed())
+		})
+
+		readStreamResult := func(connReader *bufio.Reader) (map[string]string, protocol.Result) {
+			files := map[string]string{}
+			tarStream := tar.NewReader(connReader)
+			for {
+				header, err := tarStream.Next()
+				if err == io.EOF {
+					var result protocol.Result
+					Expect(protocol.ReadMessage(connReader, &result)).To(Succeed())
+					return files, result
+				}
+				Expect(err).NotTo(HaveOccurred())
+				Expect(header.Xattrs).To(HaveKey(client.MD5_ATTRIBUTE_KEY))
+				content, err := ioutil.ReadAll(tarStream)
+				Expect(err).NotTo(HaveOccurred())
+				files[header.Name] = string(content)
+			}
+		}
+
+		readStream := func(connReader *bufio.Reader) map[string]string {
+			files, result := readStreamResult(connReader)
+			Expect(result).To(Equal(protocol.Result{}))
+			return files
+		}
+
+		It("streams a directory's contents", func() {
+			conn, connReader, resp := sendRequest(protocol.Request{Op: protocol.OpGet, Path: "/logs"})
+			defer conn.Close()
+			Expect(resp.Error).To(BeEmpty())
+			Expect(resp.Results).To(BeTrue())
+
+			Expect(readStream(connReader)).To(Equal(map[string]string{
+				"a.txt":    "content for a.txt",
+				"d1/b.txt": "content for b.txt",
+			}))
+		})
+
+		It("streams a single file", func() {
+			conn, connReader, resp := sendRequest(protocol.Request{Op: protocol.OpGet, Path: "logs/d1/b.txt"})
+			defer conn.Close()
+			Expect(resp.Error).To(BeEmpty())
+
+			Expect(readStream(connReader)).To(Equal(map[string]string{"b.txt": "content for b.txt"}))
+		})
+
+		It("does not stream kept versions", func() {
+			Expect(testhelpers.CreateFile("old", tempDir, "dest", versions.DirName, "logs", "a.txt", "20260101T000000.000000000Z")).To(Succeed())
+
+			conn, connReader, resp := sendRequest(protocol.Request{Op: protocol.OpGet})
+			defer conn.Close()
+			Expect(resp.Error).To(BeEmpty())
+
+			Expect(readStream(connReader)).To(HaveLen(2))
+		})
+
+		It("follows the stream with the error of a file it could not send", func() {
+			Expect(os.Symlink("nowhere", filepath.Join(tempDir, "dest", "logs", "d1", "c.txt"))).To(Succeed())
+
+			conn, connReader, resp := sendRequest(protocol.Request{Op: protocol.OpGet, Path: "/logs"})
+			defer conn.Close()
+			Expect(resp.Error).To(BeEmpty())
+
+			_, result := readStreamResult(connReader)
+			Expect(result).To(Equal(protocol.Result{
+				Error: "open logs/d1/c.txt: no such file or directory",
+				Code:  protocol.CodeNotFound,
+			}))
+		})
+
+		It("refuses paths that do not exist", func() {
+			conn, _, resp := sendRequest(protocol.Request{Op: protocol.OpGet, Path: "nope"})
+			defer conn.Close()
+			Expect(resp.Error).To(Equal("nope does not exist"))
+		})
+
+		It("refuses paths outside of the destination directory", func() {
+			conn, _, resp := sendRequest(protocol.Request{Op: protocol.OpGet, Path: "../src"})
+			defer conn.Close()
+			Expect(resp.Error).To(Equal("path ../src is outside of the server root"))
+		})
+
+		Context("when read access is not allowed", func() {
+			BeforeEach(func() {
+				s.Permissions.Read = false
+			})
+
+			It("refuses to send files", func() {
+				conn, _, resp := sendRequest(protocol.Request{Op: protocol.OpGet, Path: "logs"})
+				defer conn.Close()
+				Expect(resp.Error).To(Equal("read access is not allowed"))
+			})
+		})
+	})
+
+	Describe("listing files", func() {
+		BeforeEach(func() {
+			s.Permissions.Read = true
+			Expect(testhelpers.CreateFile("content for a.txt", tempDir, "dest", "logs", "a.txt")).To(Succeed())
+			Expect(testhelpers.CreateFile("content for b.txt", tempDir, "dest", "logs", "d1", "b.txt")).To(Succeed())
+			Expect(testhelpers.CreateFile("old", tempDir, "dest", versions.DirName, "logs", "a.txt", "20260101T000000.000000000Z")).To(Succeed())
+		})
+
+		list := func(req protocol.Request) protocol.Response {
+			req.Op = protocol.OpList
+			conn, _, resp := sendRequest(req)
+			conn.Close()
+			return resp
+		}
+
+		paths := func(entries []protocol.Entry) []string {
+			var paths []string
+			for _, entry := range entries {
+				paths = append(paths, entry.Path)
+			}
+			return paths
+		}
+
+		It("lists a single level", func() {
+			resp := list(protocol.Request{Path: "logs"})
+			Expect(resp.Error).To(BeEmpty())
+			Expect(paths(resp.Entries)).To(Equal([]string{"a.txt", "d1"}))
+
+			Expect(resp.Entries[0].Size).To(Equal(int64(len("content for a.txt"))))
+			Expect(resp.Entries[0].Mode.IsRegular()).To(BeTrue())
+			Expect(resp.Entries[0].ModTime).To(BeTemporally("~", time.Now(), time.Minute))
+			Expect(resp.Entries[0].MD5).To(BeEmpty())
+			Expect(resp.Entries[1].Mode.IsDir()).To(BeTrue())
+		})
+
+		It("lists recursively", func() {
+			resp := list(protocol.Request{Path: "logs", Recursive: true})
+			Expect(paths(resp.Entries)).To(Equal([]string{"a.txt", "d1", "d1/b.txt"}))
+		})
+
+		It("includes checksums when asked to", func() {
+			resp := list(protocol.Request{Path: "logs/a.txt", Checksums: true})
+			Expect(resp.Entries).To(HaveLen(1))
+			Expect(resp.Entries[0].Path).To(Equal("a.txt"))
+			Expect(resp.Entries[0].MD5).To(Equal("6e7959e79c05c665e66a35944bafbd7e"))
+		})
+
+		It("hides kept versions", func() {
+			Expect(paths(list(protocol.Request{}).Entries)).To(Equal([]string{"logs"}))
+			Expect(paths(list(protocol.Request{Recursive: true}).Entries)).NotTo(ContainElement(HavePrefix(versions.DirName)))
+		})
+
+		It("refuses paths that do not exist", func() {
+			Expect(list(protocol.Request{Path: "nope"}).Error).To(Equal("nope does not exist"))
+		})
+
+		Context("when read access is not allowed", func() {
+			BeforeEach(func() {
+				s.Permissions.Read = false
+			})
+
+			It("refuses to list files", func() {
+				Expect(list(protocol.Request{}).Error).To(Equal("read access is not allowed"))
+			})
+		})
+	})
+
+	Describe("changing files", func() {
+		var logs *gbytes.Buffer
+
+		BeforeEach(func() {
+			logs = gbytes.NewBuffer()
+			s.Logger = log.New(io.MultiWriter(logs, GinkgoWriter), "", 0)
+			s.Permissions = server.Permissions{Delete: true, Move: true, Mkdir: true}
+			Expect(testhelpers.CreateFile("content for a.txt", tempDir, "dest", "logs", "a.txt")).To(Succeed())
+		})
+
+		operate := func(req protocol.Request) string {
+			conn, _, resp := sendRequest(req)
+			conn.Close()
+			return resp.Error
+		}
+
+		Describe("removing", func() {
+			It("removes files", func() {
+				Expect(operate(protocol.Request{Op: protocol.OpRemove, Path: "logs/a.txt"})).To(BeEmpty())
+				Expect(filepath.Join(tempDir, "dest", "logs", "a.txt")).NotTo(BeAnExistingFile())
+				Expect(logs).To(gbytes.Say(`audit: client=127.0.0.1:\d+ op=rm path="logs/a.txt" to="" result="ok"`))
+			})
+
+			It("only removes non-empty directories when asked to remove recursively", func() {
+				Expect(operate(protocol.Request{Op: protocol.OpRemove, Path: "logs"})).To(Equal("remove logs: directory not empty"))
+				Expect(filepath.Join(tempDir, "dest", "logs")).To(BeADirectory())
+
+				Expect(operate(protocol.Request{Op: protocol.OpRemove, Path: "logs", Recursive: true})).To(BeEmpty())
+				Expect(filepath.Join(tempDir, "dest", "logs")).NotTo(BeADirectory())
+			})
+
+			It("refuses to remove the server root or paths outside of it", func() {
+				Expect(operate(protocol.Request{Op: protocol.OpRemove, Path: "/", Recursive: true})).To(Equal("cannot change the server root"))
+				Expect(operate(protocol.Request{Op: protocol.OpRemove, Path: "../src", Recursive: true})).To(Equal("path ../src is outside of the server root"))
+				Expect(operate(protocol.Request{Op: protocol.OpRemove, Path: versions.DirName, Recursive: true})).To(Equal("path .ezxfer-versions is reserved for file versions"))
+				Expect(filepath.Join(tempDir, "dest", "logs", "a.txt")).To(BeAnExistingFile())
+			})
+
+			It("reports paths that do not exist", func() {
+				Expect(operate(protocol.Request{Op: protocol.OpRemove, Path: "nope"})).To(Equal("nope does not exist"))
+			})
+		})
+
+		Describe("moving", func() {
+			It("moves files", func() {
+				Expect(operate(protocol.Request{Op: protocol.OpMove, Path: "logs/a.txt", To: "archive.txt"})).To(BeEmpty())
+				Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", "archive.txt"))).To(Equal([]byte("content for a.txt")))
+				Expect(logs).To(gbytes.Say(`op=mv path="logs/a.txt" to="archive.txt" result="ok"`))
+			})
+
+			It("refuses to replace existing files", func() {
+				Expect(testhelpers.CreateFile("b", tempDir, "dest", "b.txt")).To(Succeed())
+				Expect(operate(protocol.Request{Op: protocol.OpMove, Path: "logs/a.txt", To: "b.txt"})).To(Equal("b.txt already exists"))
+			})
+
+			It("refuses to move paths out of the server root", func() {
+				Expect(operate(protocol.Request{Op: protocol.OpMove, Path: "logs/a.txt", To: "../escaped.txt"})).To(Equal("path ../escaped.txt is outside of the server root"))
+				Expect(filepath.Join(tempDir, "escaped.txt")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Describe("making directories", func() {
+			It("creates directories and their parents", func() {
+				Expect(operate(protocol.Request{Op: protocol.OpMkdir, Path: "a/b/c"})).To(BeEmpty())
+				Expect(filepath.Join(tempDir, "dest", "a", "b", "c")).To(BeADirectory())
+			})
+
+			It("refuses paths outside of the server root", func() {
+				Expect(operate(protocol.Request{Op: protocol.OpMkdir, Path: "../elsewhere"})).To(Equal("path ../elsewhere is outside of the server root"))
+			})
+		})
+
+		Context("when the operations are not allowed", func() {
+			BeforeEach(func() {
+				s.Permissions = server.Permissions{Read: true, Write: true}
+			})
+
+			It("refuses them and records the refusal", func() {
+				Expect(operate(protocol.Request{Op: protocol.OpRemove, Path: "logs/a.txt"})).To(Equal("rm is not allowed"))
+				Expect(operate(protocol.Request{Op: protocol.OpMove, Path: "logs/a.txt", To: "b.txt"})).To(Equal("mv is not allowed"))
+				Expect(operate(protocol.Request{Op: protocol.OpMkdir, Path: "d"})).To(Equal("mkdir is not allowed"))
+				Expect(filepath.Join(tempDir, "dest", "logs", "a.txt")).To(BeAnExistingFile())
+				Expect(filepath.Join(tempDir, "dest", "d")).NotTo(BeADirectory())
+				Expect(logs).To(gbytes.Say(`op=rm path="logs/a.txt" to="" result="rm is not allowed"`))
+			})
+		})
+	})
+
+	Context("when the server requires a token", func() {
+		BeforeEach(func() {
+			s.Tokens = []string{"first", "second"}
+		})
+
+		It("accepts requests with any of its tokens", func() {
+			Expect(sendFiles(protocol.Request{Token: "second"}, contentMd5, "a-file.txt").Error).To(BeEmpty())
+		})
+
+		It("refuses requests without a valid token", func() {
+			conn, _, resp := sendRequest(protocol.Request{Token: "wrong"})
+			defer conn.Close()
+			Expect(resp.Error).To(Equal("invalid token"))
+		})
+	})
+
+	Describe("limiting concurrent transfers", func() {
+		var held net.Conn
+
+		BeforeEach(func() {
+			s.RetryAfter = 2 * time.Second
+		})
+
+		JustBeforeEach(func() {
+			var resp protocol.Response
+			held, _, resp = sendRequest(protocol.Request{})
+			Expect(resp.Error).To(BeEmpty())
+		})
+
+		AfterEach(func() {
+			held.Close()
+		})
+
+		expectBusy := func() {
+			conn, _, resp := sendRequest(protocol.Request{})
+			defer conn.Close()
+			Expect(resp.Error).To(Equal("server busy, retry after 2 seconds"))
+			Expect(resp.RetryAfter).To(Equal(2))
+		}
+
+		Context("when the server is at its maximum", func() {
+			BeforeEach(func() {
+				s.MaxTransfers = 1
+			})
+
+			It("refuses further transfers, asking the client to retry later", func() {
+				expectBusy()
+			})
+
+			Context("when no retry delay is set", func() {
+				BeforeEach(func() {
+					s.RetryAfter = 0
+				})
+
+				It("asks the client to retry after a default delay", func() {
+					conn, _, resp := sendRequest(protocol.Request{})
+					defer conn.Close()
+					Expect(resp.Code).To(Equal(protocol.CodeBusy))
+					Expect(resp.RetryAfter).To(Equal(5))
+				})
+			})
+
+			It("still answers requests that are not transfers", func() {
+				conn, _, resp := sendRequest(protocol.Request{Op: protocol.OpMkdir, Path: "d"})
+				defer conn.Close()
+				Expect(resp.Error).To(Equal("mkdir is not allowed"))
+			})
+
+			It("accepts transfers again once one finishes", func() {
+				held.Close()
+				Eventually(func() string {
+					conn, _, resp := sendRequest(protocol.Request{})
+					conn.Close()
+					return resp.Error
+				}).Should(BeEmpty())
+			})
+		})
+
+		Context("when a client IP is at its maximum", func() {
+			BeforeEach(func() {
+				s.MaxTransfersPerIP = 1
+			})
+
+			It("refuses further transfers from it", func() {
+				expectBusy()
+			})
+		})
+
+		Context("when the server queues transfers over the maximum", func() {
+			BeforeEach(func() {
+				s.MaxTransfers = 1
+				s.QueueWhenBusy = true
+			})
+
+			It("starts them when a slot is free", func() {
+				responses := make(chan protocol.Response, 1)
+				go func() {
+					defer GinkgoRecover()
+					conn, _, resp := sendRequest(protocol.Request{})
+					conn.Close()
+					responses <- resp
+				}()
+
+				Consistently(responses).ShouldNot(Receive())
+				held.Close()
+				Eventually(responses).Should(Receive(Equal(protocol.Response{ConflictPolicy: protocol.ConflictOverwrite, Batches: true})))
+			})
+		})
+	})
+
+	Context("when a send has more files than the process may have open", func() {
+		var originalLimit syscall.Rlimit
+
+		BeforeEach(func() {
+			Expect(syscall.Getrlimit(syscall.RLIMIT_NOFILE, &originalLimit)).To(Succeed())
+			limit := originalLimit
+			limit.Cur = 64
+			Expect(syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(syscall.Setrlimit(syscall.RLIMIT_NOFILE, &originalLimit)).To(Succeed())
+		})
+
+		It("closes each file once it is received", func() {
+			var fileNames []string
+			for i := 0; i < 200; i++ {
+				fileNames = append(fileNames, fmt.Sprintf("d%d/file-%d.txt", i%10, i))
+			}
+
+			result := sendFiles(protocol.Request{}, contentMd5, fileNames...)
+			Expect(result.Error).To(BeEmpty())
+			Expect(result.Files).To(HaveLen(200))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", "d9", "file-199.txt"))).To(Equal([]byte("some content\n")))
+		})
+	})
+
+	Describe("sends over several streams", func() {
+		// sendSlowly sends a file a byte at a time, taking longer than the
+		// stream timeout over it.
+		sendSlowly := func(req protocol.Request, fileName, content, md5 string) protocol.Result {
+			conn, connReader, resp := sendRequest(req)
+			defer conn.Close()
+			Expect(resp.Error).To(BeEmpty())
+
+			tarWriter := tar.NewWriter(conn)
+			Expect(tarWriter.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     fileName,
+				Mode:     0644,
+				Size:     int64(len(content)),
+				ModTime:  time.Now(),
+				Xattrs:   map[string]string{client.MD5_ATTRIBUTE_KEY: md5},
+			})).To(Succeed())
+			for i := range content {
+				time.Sleep(25 * time.Millisecond)
+				_, err := tarWriter.Write([]byte{content[i]})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(tarWriter.Close()).To(Succeed())
+			Expect(conn.(*net.TCPConn).CloseWrite()).To(Succeed())
+
+			var result protocol.Result
+			Expect(protocol.ReadMessage(connReader, &result)).To(Succeed())
+			return result
+		}
+
+		It("replies to each stream with the combined result of the transfer", func() {
+			results := make(chan protocol.Result, 2)
+			for _, fileName := range []string{"b.txt", "a.txt"} {
+				go func(fileName string) {
+					defer GinkgoRecover()
+					results <- sendFiles(protocol.Request{TransferID: "transfer-1", Streams: 2}, contentMd5, fileName)
+				}(fileName)
+			}
+
+			combined := protocol.Result{Files: []protocol.FileResult{
+				{Path: "a.txt", Action: protocol.ActionCreated},
+				{Path: "b.txt", Action: protocol.ActionCreated},
+			}}
+			Eventually(results).Should(Receive(Equal(combined)))
+			Eventually(results).Should(Receive(Equal(combined)))
+		})
+
+		Context("when a single file is striped between the streams", func() {
+			sendStripe := func(transferID string, offset int64, content, md5 string) protocol.Result {
+				conn, connReader, resp := sendRequest(protocol.Request{
+					TransferID: transferID,
+					Streams:    2,
+					Stripe:     &protocol.Stripe{Offset: offset, Length: int64(len(content)), FileSize: 13},
+				})
+				defer conn.Close()
+				Expect(resp.Error).To(BeEmpty())
+
+				tarWriter := tar.NewWriter(conn)
+				writeFile(tarWriter, "striped.txt", content, md5)
+				Expect(tarWriter.Close()).To(Succeed())
+				Expect(conn.(*net.TCPConn).CloseWrite()).To(Succeed())
+
+				var result protocol.Result
+				Expect(protocol.ReadMessage(connReader, &result)).To(Succeed())
+				return result
+			}
+
+			sendStripes := func(transferID, md5 string) (protocol.Result, protocol.Result) {
+				results := make(chan protocol.Result, 2)
+				for offset, content := range map[int64]string{0: "some co", 7: "ntent\n"} {
+					go func(offset int64, content string) {
+						defer GinkgoRecover()
+						results <- sendStripe(transferID, offset, content, md5)
+					}(offset, content)
+				}
+				var first, second protocol.Result
+				Eventually(results).Should(Receive(&first))
+				Eventually(results).Should(Receive(&second))
+				return first, second
+			}
+
+			It("writes each range at its offset and verifies the whole file", func() {
+				first, second := sendStripes("transfer-3", contentMd5)
+
+				combined := protocol.Result{Files: []protocol.FileResult{{Path: "striped.txt", Action: protocol.ActionCreated}}}
+				Expect(first).To(Equal(combined))
+				Expect(second).To(Equal(combined))
+				Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", "striped.txt"))).To(Equal([]byte("some content\n")))
+			})
+
+			It("reports a checksum mismatch if the whole file does not match", func() {
+				first, second := sendStripes("transfer-4", "wrong")
+
+				Expect(first.Code).To(Equal(protocol.CodeChecksum))
+				Expect(first.Error).To(ContainSubstring("md5 does not match"))
+				Expect(second.Error).To(Equal(first.Error))
+			})
+
+			It("waits for ranges that are still being received, however long they take", func() {
+				s.StreamTimeout = 100 * time.Millisecond
+				results := make(chan protocol.Result, 2)
+				go func() {
+					defer GinkgoRecover()
+					results <- sendStripe("transfer-8", 0, "so", contentMd5)
+				}()
+				go func() {
+					defer GinkgoRecover()
+					results <- sendSlowly(protocol.Request{
+						TransferID: "transfer-8",
+						Streams:    2,
+						Stripe:     &protocol.Stripe{Offset: 2, Length: 11, FileSize: 13},
+					}, "striped.txt", "me content\n", contentMd5)
+				}()
+
+				combined := protocol.Result{Files: []protocol.FileResult{{Path: "striped.txt", Action: protocol.ActionCreated}}}
+				Eventually(results, 2*time.Second).Should(Receive(Equal(combined)))
+				Eventually(results, 2*time.Second).Should(Receive(Equal(combined)))
+				Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", "striped.txt"))).To(Equal([]byte("some content\n")))
+			})
+
+			It("removes the file if a range is not received", func() {
+				s.StreamTimeout = 100 * time.Millisecond
+				result := sendStripe("transfer-5", 0, "some co", contentMd5)
+				Expect(result.Code).To(Equal(protocol.CodeInternal))
+				Eventually(func() bool {
+					_, err := os.Stat(filepath.Join(tempDir, "dest", "striped.txt"))
+					return os.IsNotExist(err)
+				}).Should(BeTrue())
+			})
+		})
+
+		It("waits for streams that are still receiving, however long they take", func() {
+			s.StreamTimeout = 100 * time.Millisecond
+			req := protocol.Request{TransferID: "transfer-6", Streams: 2}
+			results := make(chan protocol.Result, 2)
+			go func() {
+				defer GinkgoRecover()
+				results <- sendFiles(req, contentMd5, "a.txt")
+			}()
+			go func() {
+				defer GinkgoRecover()
+				results <- sendSlowly(req, "b.txt", "some content\n", contentMd5)
+			}()
+
+			combined := protocol.Result{Files: []protocol.FileResult{
+				{Path: "a.txt", Action: protocol.ActionCreated},
+				{Path: "b.txt", Action: protocol.ActionCreated},
+			}}
+			Eventually(results, 2*time.Second).Should(Receive(Equal(combined)))
+			Eventually(results, 2*time.Second).Should(Receive(Equal(combined)))
+		})
+
+		It("admits the streams of a transfer as a single transfer", func() {
+			s.MaxTransfers = 1
+			s.MaxTransfersPerIP = 1
+			results := make(chan protocol.Result, 2)
+			for _, fileName := range []string{"a.txt", "b.txt"} {
+				go func(fileName string) {
+					defer GinkgoRecover()
+					results <- sendFiles(protocol.Request{TransferID: "transfer-7", Streams: 2}, contentMd5, fileName)
+				}(fileName)
+			}
+
+			for i := 0; i < 2; i++ {
+				var result protocol.Result
+				Eventually(results).Should(Receive(&result))
+				Expect(result.Error).To(BeEmpty())
+			}
+			Eventually(func() string {
+				conn, _, resp := sendRequest(protocol.Request{})
+				conn.Close()
+				return resp.Error
+			}).Should(BeEmpty())
+		})
+
+		It("reports an error if the other streams do not finish in time", func() {
+			s.StreamTimeout = 100 * time.Millisecond
+			result := sendFiles(protocol.Request{TransferID: "transfer-2", Streams: 2}, contentMd5, "a.txt")
+			Expect(result.Error).To(Equal("timed out waiting for the other streams of the transfer"))
+			Expect(result.Files).To(HaveLen(1))
+		})
+	})
+
+	Describe("durability", func() {
+		var synced func() []string
+
+		BeforeEach(func() {
+			synced = s.RecordSyncs()
+		})
+
+		send := func() {
+			result := sendFiles(protocol.Request{Path: "incoming"}, contentMd5, "a.txt", "d1/b.txt", "d1/d2/c.txt")
+			Expect(result.Error).To(BeEmpty())
+			Expect(result.Files).To(HaveLen(3))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", "incoming", "d1", "d2", "c.txt"))).To(Equal([]byte("some content\n")))
+		}
+
+		dest := func(path ...string) string {
+			return filepath.Join(append([]string{tempDir, "dest"}, path...)...)
+		}
+
+		It("syncs each file, and the directories leading to it, as it is received with file durability", func() {
+			s.Durability = server.DurabilityFile
+			send()
+			Expect(synced()).To(Equal([]string{
+				dest("incoming", "a.txt"), dest("incoming"), dest(),
+				dest("incoming", "d1", "b.txt"), dest("incoming", "d1"), dest("incoming"), dest(),
+				dest("incoming", "d1", "d2", "c.txt"), dest("incoming", "d1", "d2"), dest("incoming", "d1"), dest("incoming"), dest(),
+			}))
+		})
+
+		It("syncs every file, then each directory once, before replying with batch durability", func() {
+			s.Durability = server.DurabilityBatch
+			send()
+			Expect(synced()).To(Equal([]string{
+				dest("incoming", "a.txt"), dest("incoming", "d1", "b.txt"), dest("incoming", "d1", "d2", "c.txt"),
+				dest("incoming"), dest(), dest("incoming", "d1"), dest("incoming", "d1", "d2"),
+			}))
+		})
+
+		It("syncs nothing with no durability", func() {
+			send()
+			Expect(synced()).To(BeEmpty())
+		})
+
+		It("parses durability settings", func() {
+			Expect(server.ParseDurability("batch")).To(Equal(server.DurabilityBatch))
+			_, err := server.ParseDurability("always")
+			Expect(err).To(MatchError(`unknown durability "always", expected one of [none file batch]`))
+		})
+	})
+
+	Describe("checking space before accepting files", func() {
+		refusal := func(req protocol.Request) string {
+			conn, _, resp := sendRequest(req)
+			defer conn.Close()
+			return resp.Error
+		}
+
+		It("refuses sends larger than the free space", func() {
+			Expect(refusal(protocol.Request{Path: "incoming", Size: 1 << 60})).To(MatchRegexp(`^not enough space: .* to send, .* available$`))
+			Expect(filepath.Join(tempDir, "dest", "incoming")).NotTo(BeADirectory())
+		})
+
+		It("replies with an error when a file cannot be preallocated", func() {
+			if runtime.GOOS != "linux" {
+				Skip("preallocation is only supported on linux")
+			}
+
+			conn, connReader, resp := sendRequest(protocol.Request{})
+			defer conn.Close()
+			Expect(resp.Error).To(BeEmpty())
+			tarWriter := tar.NewWriter(conn)
+			Expect(tarWriter.WriteHeader(&tar.Header{Name: "huge.txt", Mode: 0644, Size: 1 << 62})).To(Succeed())
+			Expect(conn.(*net.TCPConn).CloseWrite()).To(Succeed())
+
+			var result protocol.Result
+			Expect(protocol.ReadMessage(connReader, &result)).To(Succeed())
+			Expect(result.Error).To(HavePrefix("not enough space for huge.txt"))
+			Expect(filepath.Join(tempDir, "dest", "huge.txt")).NotTo(BeAnExistingFile())
+		})
+
+		It("aborts sends that send more than they announced", func() {
+			result := sendFiles(protocol.Request{Size: 20}, contentMd5, "a.txt", "b.txt")
+			Expect(result.Error).To(Equal("b.txt takes the send over its announced size of 20B"))
+			Expect(result.Code).To(Equal(protocol.CodeQuotaExceeded))
+			Expect(result.Files).To(Equal([]protocol.FileResult{{Path: "a.txt", Action: protocol.ActionCreated}}))
+			Expect(filepath.Join(tempDir, "dest", "b.txt")).NotTo(BeAnExistingFile())
+		})
+
+		It("refuses sends that do not announce their size when there are quotas", func() {
+			s.Quotas.Clients = map[string]int64{"127.0.0.1": 100}
+			conn, _, resp := sendRequest(protocol.Request{})
+			defer conn.Close()
+			Expect(resp.Error).To(Equal("sends to this server must announce their size"))
+			Expect(resp.Code).To(Equal(protocol.CodeInvalidRequest))
+		})
+
+		Context("when a directory has a quota", func() {
+			BeforeEach(func() {
+				s.Quotas.Dirs = map[string]int64{"incoming": 100}
+				s.Permissions.Delete = true
+				Expect(testhelpers.CreateFile(strings.Repeat("x", 60), tempDir, "dest", "incoming", "existing.txt")).To(Succeed())
+			})
+
+			It("refuses sends that would take it over its quota", func() {
+				conn, _, resp := sendRequest(protocol.Request{Path: "incoming/build-42", Size: 50})
+				defer conn.Close()
+				Expect(resp.Error).To(Equal("quota for incoming exceeded: 50B to send, 60B of 100B used"))
+				Expect(resp.Code).To(Equal(protocol.CodeQuotaExceeded))
+			})
+
+			It("accepts sends within its quota", func() {
+				Expect(refusal(protocol.Request{Path: "incoming", Size: 40})).To(BeEmpty())
+			})
+
+			It("does not apply to other directories", func() {
+				Expect(refusal(protocol.Request{Path: "outgoing", Size: 50})).To(BeEmpty())
+			})
+
+			It("applies to files sent into it from a parent directory", func() {
+				result := sendFiles(protocol.Request{Size: 52}, contentMd5, "incoming/a.txt", "incoming/b.txt", "incoming/c.txt", "incoming/d.txt")
+				Expect(result.Error).To(Equal("incoming/d.txt: quota for incoming exceeded: 13B to send, 99B of 100B used"))
+				Expect(result.Code).To(Equal(protocol.CodeQuotaExceeded))
+				Expect(filepath.Join(tempDir, "dest", "incoming", "c.txt")).To(BeAnExistingFile())
+				Expect(filepath.Join(tempDir, "dest", "incoming", "d.txt")).NotTo(BeAnExistingFile())
+			})
+
+			It("counts the files of sends in progress", func() {
+				conn, _, resp := sendRequest(protocol.Request{Path: "incoming", Size: 30})
+				defer conn.Close()
+				Expect(resp.Error).To(BeEmpty())
+				tarWriter := tar.NewWriter(conn)
+				Expect(tarWriter.WriteHeader(&tar.Header{Name: "partial.txt", Mode: 0644, Size: 30})).To(Succeed())
+				_, err := tarWriter.Write([]byte("0123456789"))
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(filepath.Join(tempDir, "dest", "incoming", "partial.txt")).Should(BeAnExistingFile())
+
+				Expect(refusal(protocol.Request{Path: "incoming", Size: 13})).To(Equal("quota for incoming exceeded: 13B to send, 90B of 100B used"))
+			})
+
+			It("keeps count of sends that finish while others are in progress", func() {
+				conn, connReader, resp := sendRequest(protocol.Request{Path: "incoming", Size: 20})
+				defer conn.Close()
+				Expect(resp.Error).To(BeEmpty())
+				tarWriter := tar.NewWriter(conn)
+				Expect(tarWriter.WriteHeader(&tar.Header{
+					Name:   "partial.txt",
+					Mode:   0644,
+					Size:   20,
+					Xattrs: map[string]string{client.MD5_ATTRIBUTE_KEY: fmt.Sprintf("%x", md5.Sum([]byte("01234567890123456789")))},
+				})).To(Succeed())
+				_, err := tarWriter.Write([]byte("0123456789"))
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(filepath.Join(tempDir, "dest", "incoming", "partial.txt")).Should(BeAnExistingFile())
+
+				Expect(sendFiles(protocol.Request{Path: "incoming", Size: 13}, contentMd5, "a.txt").Error).To(BeEmpty())
+				Expect(refusal(protocol.Request{Path: "incoming", Size: 10})).To(Equal("quota for incoming exceeded: 10B to send, 93B of 100B used"))
+
+				_, err = tarWriter.Write([]byte("0123456789"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(tarWriter.Close()).To(Succeed())
+				Expect(conn.(*net.TCPConn).CloseWrite()).To(Succeed())
+				var result protocol.Result
+				Expect(protocol.ReadMessage(connReader, &result)).To(Succeed())
+				Expect(result.Error).To(BeEmpty())
+				Expect(refusal(protocol.Request{Path: "incoming", Size: 10})).To(Equal("quota for incoming exceeded: 10B to send, 93B of 100B used"))
+			})
+
+			It("charges overwritten files only for the difference in size", func() {
+				Expect(sendFiles(protocol.Request{Path: "incoming", Size: 13}, contentMd5, "a.txt").Error).To(BeEmpty())
+				Expect(sendFiles(protocol.Request{Path: "incoming", Size: 13}, contentMd5, "a.txt").Error).To(BeEmpty())
+				Expect(refusal(protocol.Request{Path: "incoming", Size: 30})).To(Equal("quota for incoming exceeded: 30B to send, 73B of 100B used"))
+			})
+
+			It("no longer counts files that are removed", func() {
+				Expect(sendFiles(protocol.Request{Path: "incoming", Size: 13}, contentMd5, "a.txt").Error).To(BeEmpty())
+				conn, _, resp := sendRequest(protocol.Request{Op: protocol.OpRemove, Path: "incoming/a.txt"})
+				conn.Close()
+				Expect(resp.Error).To(BeEmpty())
+				Expect(refusal(protocol.Request{Path: "incoming", Size: 45})).To(Equal("quota for incoming exceeded: 45B to send, 60B of 100B used"))
+			})
+		})
+
+		Context("when clients have quotas", func() {
+			BeforeEach(func() {
+				s.Tokens = []string{"limited", "unlimited"}
+				s.Quotas.Clients = map[string]int64{"limited": 100}
+			})
+
+			It("refuses sends once a client has used its quota", func() {
+				result := sendFiles(protocol.Request{Token: "limited", Size: 65}, contentMd5, "a.txt", "b.txt", "c.txt", "d.txt", "e.txt")
+				Expect(result.Error).To(BeEmpty())
+				Expect(refusal(protocol.Request{Token: "limited", Size: 60})).To(Equal("client quota exceeded: 60B to send, 65B of 100B used"))
+				Expect(refusal(protocol.Request{Token: "unlimited", Size: 60})).To(BeEmpty())
+			})
+
+			It("refunds the bytes of sends that were not stored", func() {
+				clientUsage := func() int64 { return s.ClientUsage("limited") }
+				Expect(refusal(protocol.Request{Token: "limited", Size: 100})).To(BeEmpty())
+				Eventually(clientUsage).Should(BeZero())
+
+				Expect(testhelpers.CreateFile("existing", tempDir, "dest", "a.txt")).To(Succeed())
+				result := sendFiles(protocol.Request{Token: "limited", Size: 13, ConflictPolicy: protocol.ConflictSkip}, contentMd5, "a.txt")
+				Expect(result.Error).To(BeEmpty())
+				Eventually(clientUsage).Should(BeZero())
+			})
+		})
+	})
+
+	Describe("limiting bandwidth", func() {
+		BeforeEach(func() {
+			s.Permissions.Read = true
+			Expect(testhelpers.CreateFile(strings.Repeat("x", 50*1000), tempDir, "dest", "big.txt")).To(Succeed())
+		})
+
+		timeGet := func() time.Duration {
+			start := time.Now()
+			conn, connReader, resp := sendRequest(protocol.Request{Op: protocol.OpGet, Path: "big.txt"})
+			defer conn.Close()
+			Expect(resp.Error).To(BeEmpty())
+			_, err := io.Copy(ioutil.Discard, connReader)
+			Expect(err).NotTo(HaveOccurred())
+			return time.Since(start)
+		}
+
+		It("limits each connection", func() {
+			s.ConnectionLimiter = ratelimit.NewLimiter(100 * 1000)
+			Expect(timeGet()).To(BeNumerically("~", 500*time.Millisecond, 150*time.Millisecond))
+		})
+
+		It("limits all connections together", func() {
+			s.Limiter = ratelimit.NewLimiter(200 * 1000)
+			done := make(chan time.Duration, 2)
+			for i := 0; i < 2; i++ {
+				go func() {
+					defer GinkgoRecover()
+					done <- timeGet()
+				}()
+			}
+			Expect(<-done).To(BeNumerically(">", 400*time.Millisecond))
+			Expect(<-done).To(BeNumerically(">", 400*time.Millisecond))
+		})
+	})
+
+	Describe("shutting down", func() {
+		var (
+			conn       net.Conn
+			connReader *bufio.Reader
+			tarWriter  *tar.Writer
+		)
+
+		JustBeforeEach(func() {
+			var resp protocol.Response
+			conn, connReader, resp = sendRequest(protocol.Request{})
+			Expect(resp.Error).To(BeEmpty())
+
+			tarWriter = tar.NewWriter(conn)
+			Expect(tarWriter.WriteHeader(&tar.Header{
+				Name:   "a-file.txt",
+				Mode:   0644,
+				Size:   13,
+				Xattrs: map[string]string{client.MD5_ATTRIBUTE_KEY: contentMd5},
+			})).To(Succeed())
+			_, err := tarWriter.Write([]byte("some "))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(filepath.Join(tempDir, "dest", "a-file.txt")).Should(BeAnExistingFile())
+		})
+
+		AfterEach(func() {
+			conn.Close()
+		})
+
+		It("stops accepting connections but lets in-flight transfers finish", func() {
+			s.ShutdownGracePeriod = time.Minute
+			canceller()
+			Eventually(func() error {
+				conn, err := net.Dial("tcp", address)
+				if err == nil {
+					conn.Close()
+				}
+				return err
+			}).Should(HaveOccurred())
+
+			_, err := tarWriter.Write([]byte("content\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tarWriter.Close()).To(Succeed())
+			Expect(conn.(*net.TCPConn).CloseWrite()).To(Succeed())
+
+			var result protocol.Result
+			Expect(protocol.ReadMessage(connReader, &result)).To(Succeed())
+			Expect(result.Error).To(BeEmpty())
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dest", "a-file.txt"))).To(Equal([]byte("some content\n")))
+		})
+
+		It("stops streams waiting for the rest of their transfer, returning what was received", func() {
+			s.ShutdownGracePeriod = time.Minute
+			results := make(chan protocol.Result, 1)
+			go func() {
+				defer GinkgoRecover()
+				results <- sendFiles(protocol.Request{TransferID: "transfer-9", Streams: 2}, contentMd5, "b.txt")
+			}()
+			Consistently(results, 200*time.Millisecond).ShouldNot(Receive())
+			canceller()
+
+			var result protocol.Result
+			Eventually(results).Should(Receive(&result))
+			Expect(result.Error).To(Equal("transfer aborted: server is shutting down"))
+			Expect(result.Code).To(Equal(protocol.CodeBusy))
+			Expect(result.Files).To(Equal([]protocol.FileResult{{Path: "b.txt", Action: protocol.ActionCreated}}))
+		})
+
+		It("aborts transfers that outlast the grace period and removes their partial files", func() {
+			s.ShutdownGracePeriod = 100 * time.Millisecond
+			canceller()
+
+			_, err := ioutil.ReadAll(connReader)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(filepath.Join(tempDir, "dest", "a-file.txt")).ShouldNot(BeAnExistingFile())
+		})
 	})
 })
+
+var _ = Describe("serving on a listener", func() {
+	var (
+		tempDir string
+		logs    *gbytes.Buffer
+		s       *server.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "ezxfer-server-unit-tests")
+		Expect(err).NotTo(HaveOccurred())
+		logs = gbytes.NewBuffer()
+		s = &server.Server{
+			DestDir:     tempDir,
+			Logger:      log.New(io.MultiWriter(logs, GinkgoWriter), "", 0),
+			Permissions: server.Permissions{Write: true},
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tempDir)).To(Succeed())
+	})
+
+	serve := func(listener net.Listener) (context.CancelFunc, chan error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan error, 1)
+		go func() {
+			result <- s.Serve(ctx, listener)
+		}()
+		return cancel, result
+	}
+
+	mkdir := func(address string) string {
+		conn, err := net.Dial("tcp", address)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		Expect(protocol.WriteMessage(conn, protocol.Request{Op: protocol.OpMkdir, Path: "d"})).To(Succeed())
+		var resp protocol.Response
+		Expect(protocol.ReadMessage(bufio.NewReader(conn), &resp)).To(Succeed())
+		return resp.Error
+	}
+
+	It("serves on a listener bound to any free port and reports its address", func() {
+		s.Permissions.Mkdir = true
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		address := listener.Addr().String()
+
+		cancel, result := serve(listener)
+		Eventually(logs).Should(gbytes.Say("serving %s on %s", tempDir, address))
+		Expect(mkdir(address)).To(BeEmpty())
+		Expect(filepath.Join(tempDir, "d")).To(BeADirectory())
+
+		cancel()
+		Eventually(result).Should(Receive(MatchError("context canceled")))
+		_, err = net.Dial("tcp", address)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("keeps accepting after temporary errors", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		flaky := &flakyListener{Listener: listener, failures: 3}
+
+		cancel, result := serve(flaky)
+		defer cancel()
+		Expect(mkdir(listener.Addr().String())).To(Equal("mkdir is not allowed"))
+		Expect(logs).To(gbytes.Say("accept error: too many open files; retrying in 5ms"))
+		Expect(logs).To(gbytes.Say("retrying in 10ms"))
+		Expect(logs).To(gbytes.Say("retrying in 20ms"))
+		Consistently(result).ShouldNot(Receive())
+	})
+
+	It("returns permanent accept errors", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(listener.Close()).To(Succeed())
+
+		_, result := serve(listener)
+		Eventually(result).Should(Receive(HaveOccurred()))
+	})
+})
+
+// flakyListener fails its first Accepts with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package server
+
+func freeSpace(path string) (int64, error) {
+	return 0, errFreeSpaceUnknown
+}
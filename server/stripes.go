@@ -0,0 +1,255 @@
+package server
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/craigfurman/ezxfer/protocol"
+	"github.com/craigfurman/ezxfer/ratelimit"
+	"github.com/craigfurman/ezxfer/tarstream"
+)
+
+// stripedFile is a single file being received as byte ranges over several
+// connections at once.
+type stripedFile struct {
+	create sync.Once
+	// err is why the file could not be created, if it could not.
+	err    error
+	path   string
+	file   *os.File
+	header *tar.Header
+	result protocol.FileResult
+	// release releases the space reserved for the file within quotas, and
+	// saved is set once it is saved.
+	release func(saved bool)
+	saved   bool
+
+	// remaining is the number of streams yet to finish, and failed whether
+	// any of them did not receive its range.
+	remaining int
+	failed    bool
+	abandoned bool
+}
+
+// receiveStripe saves one byte range of a file sent over several connections.
+// The stream to finish last verifies the whole file and reports it in the
+// result of the transfer.
+func (s *Server) receiveStripe(conn net.Conn, connReader io.Reader, req protocol.Request, policy protocol.ConflictPolicy, space *reservation) {
+	key := s.transferKey(conn, req)
+	f := s.joinStripe(key, req.Streams)
+	defer s.abandonStripe(key, f)
+
+	tarStream := tar.NewReader(ratelimit.NewReader(connReader, s.Limiter, s.ConnectionLimiter.Split()))
+	err := s.receiveRange(tarStream, req, policy, f, space)
+	last := s.leaveStripe(key, f, err != nil)
+	if last {
+		finishErr := s.finishStripes(f)
+		s.settleStripe(f, finishErr == nil && !f.failed)
+		if err == nil {
+			err = finishErr
+		}
+	}
+
+	var result protocol.Result
+	if last && !f.failed && f.err == nil {
+		result.Files = []protocol.FileResult{f.result}
+	}
+	if err != nil {
+		s.replyError(conn, connReader, req, result, err)
+	} else {
+		s.writeResult(conn, req, result)
+	}
+
+	// Every stream waits for the last before replying, so by now it is known
+	// whether the file was saved, and its range stays charged to the client.
+	s.mu.Lock()
+	if f.saved {
+		space.stored += req.Stripe.Length
+	}
+	s.mu.Unlock()
+}
+
+// receiveRange writes the range of a striped file in tarStream, creating the
+// file if this is the first stream to get that far.
+func (s *Server) receiveRange(tarStream *tar.Reader, req protocol.Request, policy protocol.ConflictPolicy, f *stripedFile, space *reservation) error {
+	if req.Streams <= 1 || req.TransferID == "" || req.Stripe.Offset < 0 || req.Stripe.Length < 0 ||
+		req.Stripe.Offset+req.Stripe.Length > req.Stripe.FileSize {
+		return errorf(protocol.CodeInvalidRequest, "invalid stripe %+v", *req.Stripe)
+	}
+	header, err := tarStream.Next()
+	if err != nil {
+		return errorf(protocol.CodeInvalidRequest, "error reading tar stream: %s", err)
+	}
+	if header.Size != req.Stripe.Length {
+		return errorf(protocol.CodeInvalidRequest, "stripe of %s has %d bytes, expected %d", header.Name, header.Size, req.Stripe.Length)
+	}
+	if err := space.receive(header.Name, header.Size); err != nil {
+		return err
+	}
+
+	f.create.Do(func() {
+		f.err = s.createStripedFile(f, req, header, policy)
+	})
+	if f.err != nil {
+		return f.err
+	}
+	var content io.Writer = ioutil.Discard
+	if f.result.Action != protocol.ActionSkipped {
+		content = &offsetWriter{file: f.file, offset: req.Stripe.Offset}
+	}
+	if _, err := io.Copy(content, tarStream); err != nil {
+		return hideRoot(err, header.Name, "")
+	}
+
+	// Read to the end of the tar stream, so that the client has finished
+	// writing when it is replied to.
+	if _, err := tarStream.Next(); err != io.EOF {
+		return errorf(protocol.CodeInvalidRequest, "a stripe must have a single entry")
+	}
+	return nil
+}
+
+// createStripedFile decides where a striped file is saved, and creates it at
+// its full size so that each stream can write its range.
+func (s *Server) createStripedFile(f *stripedFile, req protocol.Request, header *tar.Header, policy protocol.ConflictPolicy) error {
+	filePath, fileResult, release, err := s.prepareFile(req, header, req.Stripe.FileSize, policy)
+	if err != nil {
+		return err
+	}
+	f.path, f.header, f.result = filePath, header, fileResult
+	if fileResult.Action == protocol.ActionSkipped {
+		s.Logger.Printf("skipping existing file %s", filePath)
+		return nil
+	}
+
+	s.Logger.Printf("saving file to %s over %d streams", filePath, req.Streams)
+	file, err := tarstream.CreateFile(filePath, req.Stripe.FileSize)
+	if err != nil {
+		release(false)
+		return hideRoot(err, header.Name, "")
+	}
+	if err := file.Truncate(req.Stripe.FileSize); err != nil {
+		file.Close()
+		os.Remove(filePath)
+		release(false)
+		return hideRoot(err, header.Name, "")
+	}
+	s.mu.Lock()
+	f.file, f.release = file, release
+	s.mu.Unlock()
+	return nil
+}
+
+// finishStripes closes a striped file once every range has been received and
+// verifies the checksum of the whole file, or removes it if a range is
+// missing.
+func (s *Server) finishStripes(f *stripedFile) error {
+	if f.file == nil {
+		return nil
+	}
+	name := f.header.Name
+	if err := f.file.Close(); err != nil {
+		f.failed = true
+		s.removePartial(f.path)
+		return hideRoot(err, name, "")
+	}
+	if f.failed {
+		s.removePartial(f.path)
+		return nil
+	}
+
+	if err := os.Chtimes(f.path, f.header.ModTime, f.header.ModTime); err != nil {
+		return hideRoot(err, name, "")
+	}
+	md5Sum, err := tarstream.Checksum(f.path)
+	if err != nil {
+		return hideRoot(err, name, "")
+	}
+	if expected := f.header.Xattrs[tarstream.MD5AttributeKey]; md5Sum != expected {
+		return withPrefix(name, &tarstream.ChecksumError{Expected: expected, Actual: md5Sum})
+	}
+
+	syncer := s.newSyncer()
+	if err := syncer.add(f.path); err != nil {
+		return withPrefix("error syncing "+name, hideRoot(err, name, ""))
+	}
+	return syncer.flush()
+}
+
+// settleStripe records whether a striped file was saved, and releases the
+// space reserved for it.
+func (s *Server) settleStripe(f *stripedFile, saved bool) {
+	s.mu.Lock()
+	f.saved = saved && f.file != nil
+	release := f.release
+	f.release = nil
+	s.mu.Unlock()
+	if release != nil {
+		release(f.saved)
+	}
+}
+
+// joinStripe returns the striped file of a transfer, starting it if this is
+// its first stream.
+func (s *Server) joinStripe(key string, streams int) *stripedFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stripes == nil {
+		s.stripes = map[string]*stripedFile{}
+	}
+	f, ok := s.stripes[key]
+	if !ok {
+		f = &stripedFile{remaining: streams}
+		s.stripes[key] = f
+	}
+	return f
+}
+
+// leaveStripe records that a stream of a striped file has finished, and
+// reports whether it was the last.
+func (s *Server) leaveStripe(key string, f *stripedFile, failed bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f.failed = f.failed || failed
+	f.remaining--
+	if f.remaining > 0 || f.abandoned {
+		return false
+	}
+	delete(s.stripes, key)
+	return true
+}
+
+// abandonStripe removes a striped file that some of its streams never
+// finished sending, once the others have stopped waiting for them after
+// StreamTimeout without any stream of the transfer receiving anything.
+func (s *Server) abandonStripe(key string, f *stripedFile) {
+	s.mu.Lock()
+	if f.remaining <= 0 || f.abandoned {
+		s.mu.Unlock()
+		return
+	}
+	f.abandoned = true
+	delete(s.stripes, key)
+	if f.file != nil {
+		f.file.Close()
+		s.removePartial(f.path)
+	}
+	s.mu.Unlock()
+	s.settleStripe(f, false)
+}
+
+// offsetWriter writes to a file from an offset onwards.
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
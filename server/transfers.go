@@ -0,0 +1,185 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/craigfurman/ezxfer/protocol"
+)
+
+const defaultStreamTimeout = time.Minute
+
+// transfer gathers the streams of a send made over several connections, which
+// share a single transfer slot, and their results.
+type transfer struct {
+	streams  int
+	finished int
+	result   protocol.Result
+	done     chan struct{}
+
+	// admitted is closed once the first stream has been admitted, or refused
+	// with admitErr. release frees the slot once the streams that joined the
+	// transfer, joined of them, have ended.
+	admitted chan struct{}
+	admitErr error
+	release  func()
+	joined   int
+
+	// active is when any stream last received something, in Unix
+	// nanoseconds.
+	active int64
+}
+
+func (t *transfer) touch() {
+	atomic.StoreInt64(&t.active, time.Now().UnixNano())
+}
+
+// idle returns how long it is since any stream received something.
+func (t *transfer) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&t.active)))
+}
+
+// activityReader marks a transfer active whenever a stream of it reads
+// something.
+type activityReader struct {
+	r io.Reader
+	t *transfer
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.t.touch()
+	}
+	return n, err
+}
+
+// transferKey identifies the transfer that a stream belongs to.
+func (s *Server) transferKey(conn net.Conn, req protocol.Request) string {
+	return s.clientID(conn, req) + "/" + req.TransferID
+}
+
+// admitTransfer reserves a transfer slot for a get or put. The streams of a
+// send over several connections share the slot of the first, so that limits
+// below the number of streams cannot leave a send waiting on itself. It
+// returns the transfer that the stream is part of, if any, and a function
+// that releases its share of the slot.
+func (s *Server) admitTransfer(conn net.Conn, req protocol.Request) (*transfer, func(), error) {
+	if req.Op != protocol.OpPut || req.Streams <= 1 || req.TransferID == "" {
+		release, err := s.admit(conn.RemoteAddr())
+		return nil, release, err
+	}
+	key := s.transferKey(conn, req)
+
+	s.mu.Lock()
+	if s.transfers == nil {
+		s.transfers = map[string]*transfer{}
+	}
+	t, ok := s.transfers[key]
+	if !ok {
+		t = &transfer{streams: req.Streams, done: make(chan struct{}), admitted: make(chan struct{})}
+		s.transfers[key] = t
+	}
+	t.joined++
+	s.mu.Unlock()
+
+	if !ok {
+		release, err := s.admit(conn.RemoteAddr())
+		s.mu.Lock()
+		t.release, t.admitErr = release, err
+		if err != nil && s.transfers[key] == t {
+			delete(s.transfers, key)
+		}
+		close(t.admitted)
+		s.mu.Unlock()
+	}
+	<-t.admitted
+	if t.admitErr != nil {
+		return nil, nil, t.admitErr
+	}
+
+	t.touch()
+	return t, func() {
+		s.mu.Lock()
+		t.joined--
+		last := t.joined == 0
+		if last && s.transfers[key] == t {
+			delete(s.transfers, key)
+		}
+		s.mu.Unlock()
+		if last {
+			t.release()
+		}
+	}, nil
+}
+
+// combineResult adds the result of one stream of a transfer to the results
+// of the others, waits for them all to finish, and returns the result of the
+// whole transfer. It stops waiting once none of the streams has received
+// anything for StreamTimeout, or once the server stops, and returns what was
+// received so far. Sends over a single connection are returned as they are.
+func (s *Server) combineResult(key string, req protocol.Request, result protocol.Result) protocol.Result {
+	if req.Streams <= 1 || req.TransferID == "" {
+		return result
+	}
+	stopped := s.stopSignal()
+
+	s.mu.Lock()
+	t, ok := s.transfers[key]
+	if !ok {
+		// The other streams stopped waiting for this one.
+		s.mu.Unlock()
+		result.Error, result.Code = "timed out waiting for the other streams of the transfer", protocol.CodeInternal
+		return result
+	}
+	t.finished++
+	t.result.Files = append(t.result.Files, result.Files...)
+	if t.result.Error == "" && result.Error != "" {
+		t.result.Error, t.result.Code = result.Error, result.Code
+	}
+	if t.finished == t.streams {
+		sort.SliceStable(t.result.Files, func(i, j int) bool {
+			return t.result.Files[i].Path < t.result.Files[j].Path
+		})
+		delete(s.transfers, key)
+		close(t.done)
+	}
+	s.mu.Unlock()
+
+	timeout := s.StreamTimeout
+	if timeout == 0 {
+		timeout = defaultStreamTimeout
+	}
+	reason, code := "timed out waiting for the other streams of the transfer", protocol.CodeInternal
+wait:
+	for idle := t.idle(); idle < timeout; idle = t.idle() {
+		select {
+		case <-t.done:
+			return t.result
+		case <-stopped:
+			reason, code = errAborted.Error(), errorCode(errAborted)
+			break wait
+		case <-time.After(timeout - idle):
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-t.done:
+		return t.result
+	default:
+	}
+	if s.transfers[key] == t {
+		delete(s.transfers, key)
+	}
+	partial := t.result
+	partial.Files = append([]protocol.FileResult(nil), t.result.Files...)
+	if partial.Error == "" {
+		partial.Error, partial.Code = reason, code
+	}
+	return partial
+}
@@ -0,0 +1,132 @@
+package tarstream
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// BatchAttributeKey marks an entry that holds a batch of small files, as a
+// tar stream of its own, and gives how many. The batch is checksummed as a
+// whole, rather than each file.
+const BatchAttributeKey = "batch"
+
+const DefaultBatchSize = 4 << 20
+
+// MaxBatchSize is the largest batch entry that ReceiveBatch accepts, as each
+// is held in memory until its checksum is verified.
+const MaxBatchSize = 16 * DefaultBatchSize
+
+// IsBatch reports whether header is that of a batch of small files.
+func IsBatch(header *tar.Header) bool {
+	_, ok := header.Xattrs[BatchAttributeKey]
+	return ok
+}
+
+// ReceiveBatch verifies the checksum of the batch entry with header, then
+// calls receive with the header and content of each file in it, so that no
+// file of a corrupt batch is received.
+func ReceiveBatch(content io.Reader, header *tar.Header, receive func(*tar.Header, io.Reader) error) error {
+	if header.Size > MaxBatchSize {
+		return fmt.Errorf("batch of %d bytes is larger than the maximum of %d", header.Size, MaxBatchSize)
+	}
+	var batch bytes.Buffer
+	checksumWriter := md5.New()
+	if _, err := io.Copy(io.MultiWriter(&batch, checksumWriter), content); err != nil {
+		return err
+	}
+	md5Sum := hex.EncodeToString(checksumWriter.Sum(nil))
+	if expected := header.Xattrs[MD5AttributeKey]; md5Sum != expected {
+		return &ChecksumError{Expected: expected, Actual: md5Sum}
+	}
+
+	files := tar.NewReader(&batch)
+	for {
+		fileHeader, err := files.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := receive(fileHeader, files); err != nil {
+			return err
+		}
+	}
+}
+
+// batch gathers small files to be written as a single entry.
+type batch struct {
+	buf   bytes.Buffer
+	tar   *tar.Writer
+	files []*tar.Header
+}
+
+func newBatch() *batch {
+	b := &batch{}
+	b.tar = tar.NewWriter(&b.buf)
+	return b
+}
+
+func (b *batch) add(header *tar.Header, content []byte) error {
+	if err := b.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := b.tar.Write(content); err != nil {
+		return err
+	}
+	b.files = append(b.files, header)
+	return nil
+}
+
+// writeBatch writes the files gathered in b as a single entry, and empties it.
+// The Observer is told of each file once the whole batch has been written.
+func (w *Writer) writeBatch(b *batch) error {
+	if len(b.files) == 0 {
+		return nil
+	}
+	if err := b.tar.Close(); err != nil {
+		return err
+	}
+
+	sum := md5.Sum(b.buf.Bytes())
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ".batch",
+		Mode:     0644,
+		Size:     int64(b.buf.Len()),
+		ModTime:  time.Now(),
+		Xattrs: map[string]string{
+			MD5AttributeKey:   hex.EncodeToString(sum[:]),
+			BatchAttributeKey: strconv.Itoa(len(b.files)),
+		},
+	}
+	err := w.WriteHeader(header)
+	if err == nil {
+		_, err = io.Copy(w, &b.buf)
+	}
+	observer := w.observer()
+	for _, fileHeader := range b.files {
+		// Progress is counted in the files' contents, not the batch's own
+		// encoding of them.
+		observer.FileStarted(fileHeader.Name, fileHeader.Size)
+		if err != nil {
+			observer.FileFailed(fileHeader.Name, err)
+			continue
+		}
+		observer.BytesWritten(fileHeader.Name, fileHeader.Size)
+	}
+	if err != nil {
+		return err
+	}
+
+	b.buf.Reset()
+	b.tar = tar.NewWriter(&b.buf)
+	b.files = nil
+	return nil
+}
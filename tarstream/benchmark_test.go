@@ -0,0 +1,78 @@
+package tarstream_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/craigfurman/ezxfer/tarstream"
+)
+
+const benchmarkFileSize = 64 << 20
+
+// BenchmarkWriteRange compares copying a file through the tar writer with
+// copying it around it, without checksumming the file each time.
+func BenchmarkWriteRange(b *testing.B) {
+	tempDir, err := ioutil.TempDir("", "ezxfer-tarstream-benchmarks")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	filePath := filepath.Join(tempDir, "big")
+	if err := ioutil.WriteFile(filePath, make([]byte, benchmarkFileSize), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, zeroCopy := range []bool{false, true} {
+		name := "tee"
+		if zeroCopy {
+			name = "zero-copy"
+		}
+		b.Run(name, func(b *testing.B) {
+			conn, done := discardingConn(b)
+			defer func() {
+				conn.Close()
+				<-done
+			}()
+			tarWriter := tarstream.NewWriter(conn)
+			tarWriter.ZeroCopy = zeroCopy
+
+			b.SetBytes(benchmarkFileSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := tarWriter.WriteRange(filePath, 0, benchmarkFileSize, "unchecked"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// discardingConn returns a TCP connection to a local listener that discards
+// everything sent to it, and a channel closed once it has stopped.
+func discardingConn(b *testing.B) (net.Conn, chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return conn, done
+}
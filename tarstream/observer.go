@@ -0,0 +1,50 @@
+package tarstream
+
+// Observer is told of the progress of each file written to a stream. It may be
+// shared by the Writers of several streams at once.
+type Observer interface {
+	// FileStarted is called as a file, or a range of one, starts to be
+	// written, with the number of bytes to be written.
+	FileStarted(name string, size int64)
+	// BytesWritten counts n more bytes of a file written.
+	BytesWritten(name string, n int64)
+	// FileFailed is called when a file cannot be written.
+	FileFailed(name string, err error)
+}
+
+type noObserver struct{}
+
+func (noObserver) FileStarted(string, int64)  {}
+func (noObserver) BytesWritten(string, int64) {}
+func (noObserver) FileFailed(string, error)   {}
+
+func (w *Writer) observer() Observer {
+	if w.Observer == nil {
+		return noObserver{}
+	}
+	return w.Observer
+}
+
+// startFile tells the Observer that name has started, and returns what its
+// progress is reported through.
+func (w *Writer) startFile(name string, size int64) fileProgress {
+	observer := w.observer()
+	observer.FileStarted(name, size)
+	return fileProgress{observer: observer, name: name}
+}
+
+// fileProgress reports the bytes written of a file, either by being written
+// them or, when they do not pass through user space, by being told how many.
+type fileProgress struct {
+	observer Observer
+	name     string
+}
+
+func (p fileProgress) Write(b []byte) (int, error) {
+	p.add(int64(len(b)))
+	return len(b), nil
+}
+
+func (p fileProgress) add(n int64) {
+	p.observer.BytesWritten(p.name, n)
+}
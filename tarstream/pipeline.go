@@ -0,0 +1,248 @@
+package tarstream
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// errStopped stops a walk once the stream has failed.
+var errStopped = errors.New("stopped")
+
+// entry is a file on its way into the stream. It is ready once it has been
+// opened and checksummed, or read whole if it is small enough to be batched,
+// or has failed to be.
+type entry struct {
+	path string
+	// name is the path of the file in the stream.
+	name    string
+	file    *os.File
+	header  *tar.Header
+	batched bool
+	content []byte
+	err     error
+	ready   chan struct{}
+}
+
+func newEntry(basePath, filePath string) *entry {
+	name := filePath
+	if relativePath, err := filepath.Rel(basePath, filePath); err == nil {
+		name = relativePath
+	}
+	return &entry{path: filePath, name: filepath.ToSlash(name), ready: make(chan struct{})}
+}
+
+// WritePaths writes the files at paths to the stream, in order, with their
+// paths relative to basePath.
+func (w *Writer) WritePaths(basePath string, paths []string) error {
+	return w.writePipelined(basePath, func(send func(string) bool) error {
+		for _, path := range paths {
+			if !send(path) {
+				return errStopped
+			}
+		}
+		return nil
+	})
+}
+
+// writePipelined writes the files that walk sends, in the order it sends them.
+// While each is written, up to Hashers of those that follow are opened and
+// checksummed, so that the stream is not held up by each file in turn. Small
+// files are batched if SmallFileSize is set. walk stops when send returns
+// false.
+func (w *Writer) writePipelined(basePath string, walk func(send func(string) bool) error) error {
+	hashers := w.Hashers
+	if hashers <= 0 {
+		hashers = DefaultHashers
+	}
+	// Both queues are bounded, which bounds how many files are open at once.
+	pending := make(chan *entry, hashers)
+	work := make(chan *entry)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < hashers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := w.buffer()
+			for e := range work {
+				openEntry(basePath, e, buf, w.SmallFileSize)
+			}
+		}()
+	}
+
+	var walkErr error
+	go func() {
+		defer close(pending)
+		defer close(work)
+		walkErr = walk(func(path string) bool {
+			e := newEntry(basePath, path)
+			select {
+			case pending <- e:
+			case <-stop:
+				return false
+			}
+			select {
+			case work <- e:
+				return true
+			case <-stop:
+				e.err = errStopped
+				close(e.ready)
+				return false
+			}
+		})
+	}()
+
+	var err error
+	b := newBatch()
+	for e := range pending {
+		if err != nil {
+			<-e.ready
+			if e.file != nil {
+				e.file.Close()
+			}
+			continue
+		}
+		if err = w.writeQueued(e, b); err != nil {
+			close(stop)
+		}
+	}
+	if err == nil {
+		err = w.writeBatch(b)
+	}
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	if walkErr == errStopped {
+		return nil
+	}
+	return walkErr
+}
+
+// openEntry opens the file of e, and prepares its header with its checksum,
+// reading it with buf. Files smaller than smallFileSize are instead read whole
+// and closed, to be batched.
+func openEntry(basePath string, e *entry, buf []byte, smallFileSize int64) {
+	defer close(e.ready)
+	if e.file, e.err = os.Open(e.path); e.err != nil {
+		return
+	}
+	e.header, e.err = header(basePath, e.path, e.file)
+	if e.err == nil && e.header.Size < smallFileSize {
+		e.batched = true
+		e.content = make([]byte, e.header.Size)
+		_, e.err = io.ReadFull(e.file, e.content)
+		e.file.Close()
+		e.file = nil
+		return
+	}
+	if e.err == nil {
+		e.err = addChecksum(e.header, e.file, buf)
+	}
+	if e.err != nil {
+		e.file.Close()
+		e.file = nil
+	}
+}
+
+func header(basePath, filePath string, file *os.File) (*tar.Header, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	relativePath, err := filepath.Rel(basePath, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := tar.FileInfoHeader(fileInfo, "What even is this? It seems to make no difference")
+	if err != nil {
+		return nil, err
+	}
+	header.Name = filepath.ToSlash(relativePath)
+	return header, nil
+}
+
+// addChecksum adds the checksum of file, read with buf, to its header.
+func addChecksum(header *tar.Header, file *os.File, buf []byte) error {
+	md5Checksum, err := checksum(file, buf)
+	if err != nil {
+		return err
+	}
+	header.Xattrs = map[string]string{MD5AttributeKey: md5Checksum}
+
+	_, err = file.Seek(0, io.SeekStart)
+	return err
+}
+
+// writeQueued adds a small file to b, writing the batch once it is full, or
+// writes any batch so far and then a larger file.
+func (w *Writer) writeQueued(e *entry, b *batch) error {
+	<-e.ready
+	if e.err != nil {
+		return w.failed(e)
+	}
+	if !e.batched {
+		if err := w.writeBatch(b); err != nil {
+			e.file.Close()
+			return err
+		}
+		return w.writeOpened(e)
+	}
+
+	if err := b.add(e.header, e.content); err != nil {
+		return err
+	}
+	batchSize := w.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	if b.buf.Len() >= batchSize {
+		return w.writeBatch(b)
+	}
+	return nil
+}
+
+// writeOpened writes an entry once it is ready, and closes its file.
+func (w *Writer) writeOpened(e *entry) error {
+	<-e.ready
+	if e.err != nil {
+		return w.failed(e)
+	}
+	defer e.file.Close()
+
+	e.err = w.writeEntry(e.header, e.file, 0, w.startFile(e.name, e.header.Size))
+	if e.err != nil {
+		return w.failed(e)
+	}
+	return nil
+}
+
+// failed tells the Observer that an entry could not be written, and returns
+// why.
+func (w *Writer) failed(e *entry) error {
+	if e.err != errStopped {
+		w.observer().FileFailed(e.name, e.err)
+	}
+	return e.err
+}
+
+// copyBuffer returns the buffer files are written to the stream with.
+func (w *Writer) copyBuffer() []byte {
+	if w.buf == nil {
+		w.buf = w.buffer()
+	}
+	return w.buf
+}
+
+func (w *Writer) buffer() []byte {
+	if w.BufferSize <= 0 {
+		return make([]byte, DefaultBufferSize)
+	}
+	return make([]byte, w.BufferSize)
+}
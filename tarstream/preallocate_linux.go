@@ -0,0 +1,24 @@
+package tarstream
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves size bytes for file, so that it is not fragmented and
+// running out of space is found before writing. Filesystems that cannot
+// preallocate are left to allocate as the file is written.
+func preallocate(file *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := unix.Fallocate(int(file.Fd()), 0, 0, size)
+	switch err {
+	case nil, unix.EOPNOTSUPP, unix.ENOSYS, unix.EINVAL:
+		return nil
+	case unix.ENOSPC, unix.EDQUOT, unix.EFBIG:
+		return &SpaceError{Path: file.Name(), Size: size, Err: err}
+	}
+	return err
+}
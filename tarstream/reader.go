@@ -0,0 +1,92 @@
+package tarstream
+
+import (
+	"archive/tar"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/craigfurman/ezxfer/units"
+)
+
+// ChecksumError is returned when a received file does not match the checksum
+// it was sent with.
+type ChecksumError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("md5 does not match: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// SpaceError is returned when there is not enough space, or quota, for a
+// received file.
+type SpaceError struct {
+	Path string
+	Size int64
+	Err  error
+}
+
+func (e *SpaceError) Error() string {
+	return fmt.Sprintf("not enough space for %s (%s): %s", filepath.Base(e.Path), units.FormatBytes(e.Size), e.Err)
+}
+
+// CreateFile creates filePath and its parent directories, and preallocates
+// size bytes for it where the filesystem supports it.
+func CreateFile(filePath string, size int64) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := preallocate(file, size); err != nil {
+		file.Close()
+		os.Remove(filePath)
+		return nil, err
+	}
+	return file, nil
+}
+
+// ReceiveFile saves the content of the current entry in a tar stream to
+// filePath, creating its parent directories, and verifies its checksum. Space
+// for the file is preallocated where the filesystem supports it.
+func ReceiveFile(content io.Reader, header *tar.Header, filePath string) error {
+	checksumWriter := md5.New()
+	if err := SaveFile(io.TeeReader(content, checksumWriter), header, filePath); err != nil {
+		return err
+	}
+
+	md5Sum := hex.EncodeToString(checksumWriter.Sum(nil))
+	expectedMd5Sum := header.Xattrs[MD5AttributeKey]
+	if md5Sum != expectedMd5Sum {
+		return &ChecksumError{Expected: expectedMd5Sum, Actual: md5Sum}
+	}
+	return nil
+}
+
+// SaveFile saves content to filePath as ReceiveFile does, without a checksum
+// of its own, as for the files of a batch.
+func SaveFile(content io.Reader, header *tar.Header, filePath string) error {
+	file, err := CreateFile(filePath, header.Size)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, content); err != nil {
+		return err
+	}
+	// Close now, rather than leaving it to the deferred Close, to report
+	// errors writing back the file.
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(filePath, header.ModTime, header.ModTime)
+}
@@ -0,0 +1,310 @@
+package tarstream_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/craigfurman/ezxfer/tarstream"
+	"github.com/craigfurman/ezxfer/testhelpers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tar streams", func() {
+	var (
+		tempDir string
+		stream  *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "ezxfer-tarstream-tests")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testhelpers.CreateFile("content for a.txt", tempDir, "src", "a.txt")).To(Succeed())
+		Expect(testhelpers.CreateFile("content for b.txt", tempDir, "src", "d1", "b.txt")).To(Succeed())
+		Expect(testhelpers.CreateFile("content for c.txt", tempDir, "src", "skipped", "c.txt")).To(Succeed())
+		stream = new(bytes.Buffer)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tempDir)).To(Succeed())
+	})
+
+	writeFiles := func(filePath string) {
+		tarWriter := tarstream.NewWriter(stream)
+		tarWriter.SkipDirs = []string{filepath.Join(tempDir, "src", "skipped")}
+		Expect(tarWriter.WriteFiles(filePath)).To(Succeed())
+		Expect(tarWriter.Close()).To(Succeed())
+	}
+
+	receiveAll := func() error {
+		tarReader := tar.NewReader(stream)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				return nil
+			}
+			Expect(err).NotTo(HaveOccurred())
+			if err := tarstream.ReceiveFile(tarReader, header, filepath.Join(tempDir, "dst", header.Name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	It("round trips a directory's contents, except skipped directories", func() {
+		writeFiles(filepath.Join(tempDir, "src"))
+		Expect(receiveAll()).To(Succeed())
+
+		Expect(ioutil.ReadFile(filepath.Join(tempDir, "dst", "a.txt"))).To(Equal([]byte("content for a.txt")))
+		Expect(ioutil.ReadFile(filepath.Join(tempDir, "dst", "d1", "b.txt"))).To(Equal([]byte("content for b.txt")))
+		Expect(filepath.Join(tempDir, "dst", "skipped")).NotTo(BeADirectory())
+	})
+
+	It("round trips files whose contents are copied around the tar writer", func() {
+		observer := newRecordingObserver()
+		tarWriter := tarstream.NewWriter(stream)
+		tarWriter.Observer = observer
+		Expect(tarWriter.WriteFile(filepath.Join(tempDir, "src"), filepath.Join(tempDir, "src", "a.txt"))).To(Succeed())
+		tarWriter.ZeroCopy = true
+		Expect(tarWriter.WriteFiles(filepath.Join(tempDir, "src", "d1"))).To(Succeed())
+		Expect(tarWriter.WriteRange(filepath.Join(tempDir, "src", "skipped", "c.txt"), 8, 9, "ignored")).To(Succeed())
+		Expect(tarWriter.Close()).To(Succeed())
+
+		tarReader := tar.NewReader(stream)
+		contents := map[string]string{}
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).NotTo(HaveOccurred())
+			content, err := ioutil.ReadAll(tarReader)
+			Expect(err).NotTo(HaveOccurred())
+			contents[header.Name] = string(content)
+		}
+		Expect(contents).To(Equal(map[string]string{"a.txt": "content for a.txt", "b.txt": "content for b.txt", "c.txt": "for c.txt"}))
+		Expect(observer.started).To(Equal([]string{"a.txt", "b.txt", "c.txt"}))
+		Expect(observer.written).To(Equal(map[string]int64{"a.txt": 17, "b.txt": 17, "c.txt": 9}))
+	})
+
+	Context("when reading and checksumming files ahead of the one being written", func() {
+		var names []string
+
+		BeforeEach(func() {
+			names = nil
+			for i := 0; i < 50; i++ {
+				name := fmt.Sprintf("d%d/file-%02d.txt", i%3, i)
+				Expect(testhelpers.CreateFile(fmt.Sprintf("content for %s", name), tempDir, "many", name)).To(Succeed())
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		})
+
+		It("writes them in the order they are walked", func() {
+			tarWriter := tarstream.NewWriter(stream)
+			tarWriter.Hashers = 8
+			tarWriter.BufferSize = 7
+			Expect(tarWriter.WriteFiles(filepath.Join(tempDir, "many"))).To(Succeed())
+			Expect(tarWriter.Close()).To(Succeed())
+
+			tarReader := tar.NewReader(stream)
+			var written []string
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+				written = append(written, header.Name)
+				Expect(tarstream.ReceiveFile(tarReader, header, filepath.Join(tempDir, "dst", header.Name))).To(Succeed())
+			}
+			Expect(written).To(Equal(names))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dst", "d2", "file-47.txt"))).To(Equal([]byte("content for d2/file-47.txt")))
+		})
+
+		It("stops at the first file that cannot be read", func() {
+			Expect(os.Symlink(filepath.Join(tempDir, "missing"), filepath.Join(tempDir, "many", "d1", "file-00.txt"))).To(Succeed())
+
+			tarWriter := tarstream.NewWriter(stream)
+			err := tarWriter.WriteFiles(filepath.Join(tempDir, "many"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			tarReader := tar.NewReader(stream)
+			var written []string
+			for {
+				header, err := tarReader.Next()
+				if err != nil {
+					break
+				}
+				written = append(written, header.Name)
+			}
+			Expect(written).To(Equal([]string{"d0/file-00.txt", "d0/file-03.txt", "d0/file-06.txt", "d0/file-09.txt", "d0/file-12.txt", "d0/file-15.txt", "d0/file-18.txt", "d0/file-21.txt", "d0/file-24.txt", "d0/file-27.txt", "d0/file-30.txt", "d0/file-33.txt", "d0/file-36.txt", "d0/file-39.txt", "d0/file-42.txt", "d0/file-45.txt", "d0/file-48.txt"}))
+		})
+	})
+
+	Context("when small files are batched", func() {
+		writeBatched := func(observer tarstream.Observer) {
+			Expect(testhelpers.CreateFile(strings.Repeat("x", 100), tempDir, "src", "large.txt")).To(Succeed())
+			tarWriter := tarstream.NewWriter(stream)
+			tarWriter.SmallFileSize = 50
+			tarWriter.Observer = observer
+			Expect(tarWriter.WriteFiles(filepath.Join(tempDir, "src"))).To(Succeed())
+			Expect(tarWriter.Close()).To(Succeed())
+		}
+
+		receiveBatched := func() ([]string, error) {
+			var entries []string
+			tarReader := tar.NewReader(stream)
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					return entries, nil
+				}
+				Expect(err).NotTo(HaveOccurred())
+				if !tarstream.IsBatch(header) {
+					entries = append(entries, header.Name)
+					Expect(tarstream.ReceiveFile(tarReader, header, filepath.Join(tempDir, "dst", header.Name))).To(Succeed())
+					continue
+				}
+				entries = append(entries, "batch of "+header.Xattrs[tarstream.BatchAttributeKey])
+				if err := tarstream.ReceiveBatch(tarReader, header, func(fileHeader *tar.Header, content io.Reader) error {
+					return tarstream.SaveFile(content, fileHeader, filepath.Join(tempDir, "dst", fileHeader.Name))
+				}); err != nil {
+					return entries, err
+				}
+			}
+		}
+
+		It("writes them as batches between the larger files, observing each file in them", func() {
+			observer := newRecordingObserver()
+			writeBatched(observer)
+			Expect(observer.started).To(Equal([]string{"a.txt", "d1/b.txt", "large.txt", "skipped/c.txt"}))
+			Expect(observer.written).To(Equal(map[string]int64{"a.txt": 17, "d1/b.txt": 17, "large.txt": 100, "skipped/c.txt": 17}))
+
+			Expect(receiveBatched()).To(Equal([]string{"batch of 2", "large.txt", "batch of 1"}))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dst", "a.txt"))).To(Equal([]byte("content for a.txt")))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dst", "d1", "b.txt"))).To(Equal([]byte("content for b.txt")))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dst", "skipped", "c.txt"))).To(Equal([]byte("content for c.txt")))
+		})
+
+		It("returns a checksum error when a batch does not match its checksum", func() {
+			writeBatched(nil)
+			corrupted := bytes.Replace(stream.Bytes(), []byte("content for b.txt"), []byte("content for B.txt"), 1)
+			stream = bytes.NewBuffer(corrupted)
+
+			_, err := receiveBatched()
+			Expect(err).To(BeAssignableToTypeOf(&tarstream.ChecksumError{}))
+			Expect(filepath.Join(tempDir, "dst", "a.txt")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	It("round trips a single file", func() {
+		writeFiles(filepath.Join(tempDir, "src", "d1", "b.txt"))
+		Expect(receiveAll()).To(Succeed())
+
+		Expect(ioutil.ReadFile(filepath.Join(tempDir, "dst", "b.txt"))).To(Equal([]byte("content for b.txt")))
+	})
+
+	It("returns a space error, and removes the file, when its size cannot be preallocated", func() {
+		if runtime.GOOS != "linux" {
+			Skip("preallocation is only supported on linux")
+		}
+
+		filePath := filepath.Join(tempDir, "dest", "huge.txt")
+		err := tarstream.ReceiveFile(bytes.NewReader(nil), &tar.Header{Name: "huge.txt", Size: 1 << 62}, filePath)
+		Expect(err).To(BeAssignableToTypeOf(&tarstream.SpaceError{}))
+		Expect(err).To(MatchError(MatchRegexp(`^not enough space for huge.txt \(.*\): `)))
+		Expect(filePath).NotTo(BeAnExistingFile())
+	})
+
+	It("observes files that cannot be written", func() {
+		observer := newRecordingObserver()
+		tarWriter := tarstream.NewWriter(stream)
+		tarWriter.Observer = observer
+		srcDir := filepath.Join(tempDir, "src")
+		err := tarWriter.WritePaths(srcDir, []string{filepath.Join(srcDir, "a.txt"), filepath.Join(srcDir, "missing.txt")})
+		Expect(err).To(HaveOccurred())
+
+		Expect(observer.started).To(Equal([]string{"a.txt"}))
+		Expect(observer.failed).To(Equal(map[string]error{"missing.txt": err}))
+	})
+
+	It("will not close a stream that ends part way through a file", func() {
+		for _, zeroCopy := range []bool{false, true} {
+			tarWriter := tarstream.NewWriter(&failingWriter{left: 600})
+			tarWriter.ZeroCopy = zeroCopy
+			err := tarWriter.WriteFiles(filepath.Join(tempDir, "src", "a.txt"))
+			Expect(err).To(MatchError("stream broken"))
+			Expect(tarWriter.Close()).To(MatchError("tar stream ends part way through an entry: stream broken"))
+		}
+	})
+
+	It("totals the size of the files to be written", func() {
+		Expect(tarstream.Size(filepath.Join(tempDir, "src"))).To(Equal(int64(3 * len("content for a.txt"))))
+		Expect(tarstream.Size(filepath.Join(tempDir, "src", "a.txt"))).To(Equal(int64(len("content for a.txt"))))
+	})
+
+	It("returns a checksum error when content does not match its checksum", func() {
+		tarWriter := tar.NewWriter(stream)
+		Expect(tarWriter.WriteHeader(&tar.Header{
+			Name:   "a.txt",
+			Mode:   0644,
+			Size:   4,
+			Xattrs: map[string]string{tarstream.MD5AttributeKey: "wrong"},
+		})).To(Succeed())
+		_, err := tarWriter.Write([]byte("oops"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tarWriter.Close()).To(Succeed())
+
+		err = receiveAll()
+		Expect(err).To(BeAssignableToTypeOf(&tarstream.ChecksumError{}))
+		Expect(err.(*tarstream.ChecksumError).Expected).To(Equal("wrong"))
+	})
+})
+
+// recordingObserver records the files it is told of.
+type recordingObserver struct {
+	started []string
+	written map[string]int64
+	failed  map[string]error
+}
+
+func newRecordingObserver() *recordingObserver {
+	return &recordingObserver{written: map[string]int64{}, failed: map[string]error{}}
+}
+
+func (o *recordingObserver) FileStarted(name string, size int64) {
+	o.started = append(o.started, name)
+}
+
+func (o *recordingObserver) BytesWritten(name string, n int64) {
+	o.written[name] += n
+}
+
+func (o *recordingObserver) FileFailed(name string, err error) {
+	o.failed[name] = err
+}
+
+// failingWriter fails once it has been given left bytes.
+type failingWriter struct {
+	left int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		n := w.left
+		w.left = 0
+		return n, errors.New("stream broken")
+	}
+	w.left -= len(p)
+	return len(p), nil
+}
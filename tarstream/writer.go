@@ -0,0 +1,206 @@
+// Package tarstream writes files into, and reads them out of, the tar streams
+// that clients and servers exchange. Each file's MD5 checksum travels with it
+// as an extended attribute.
+package tarstream
+
+import (
+	"archive/tar"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const MD5AttributeKey = "md5"
+
+type Writer struct {
+	*tar.Writer
+	// Observer, if set, is told of the progress of each file.
+	Observer Observer
+	// SkipDirs are directories whose contents are not written.
+	SkipDirs []string
+	// ZeroCopy copies file contents straight to the underlying writer rather
+	// than through the tar.Writer, so that when it is a TCP connection the
+	// kernel can send them with sendfile(2) or splice(2) where supported.
+	ZeroCopy bool
+	// Hashers is how many files are opened and checksummed ahead of the one
+	// being written. DefaultHashers is used if it is 0.
+	Hashers int
+	// BufferSize is the size of the buffers files are read with.
+	// DefaultBufferSize is used if it is 0.
+	BufferSize int
+	// SmallFileSize, if set, is the size below which the files of a directory
+	// are gathered into batches of up to BatchSize bytes, each written as a
+	// single entry with a single checksum. Only servers that
+	// accept batches can receive them.
+	SmallFileSize int64
+	// BatchSize is DefaultBatchSize if it is 0.
+	BatchSize int
+
+	w   io.Writer
+	buf []byte
+	// broken is why an entry was left part written, if one was.
+	broken error
+}
+
+const (
+	DefaultHashers    = 4
+	DefaultBufferSize = 1 << 20
+)
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{Writer: tar.NewWriter(w), w: w}
+}
+
+// WriteFiles writes the file at filePath, or the contents of the directory at
+// filePath, to the stream. Paths in the stream are relative to the directory.
+func (w *Writer) WriteFiles(filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return w.writeDir(filePath)
+	}
+	return w.WriteFile(filepath.Dir(filePath), filePath)
+}
+
+// WriteFile writes a single file to the stream, with its path relative to
+// basePath.
+func (w *Writer) WriteFile(basePath string, filePath string) error {
+	e := newEntry(basePath, filePath)
+	openEntry(basePath, e, w.copyBuffer(), 0)
+	return w.writeOpened(e)
+}
+
+// WriteRange writes length bytes of the file at filePath, from offset, as an
+// entry named after the file with the checksum of the whole file, md5.
+func (w *Writer) WriteRange(filePath string, offset, length int64, md5 string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(fileInfo, "")
+	if err != nil {
+		return err
+	}
+	header.Size = length
+	header.Xattrs = map[string]string{MD5AttributeKey: md5}
+
+	if err := w.writeEntry(header, file, offset, w.startFile(header.Name, length)); err != nil {
+		w.observer().FileFailed(header.Name, err)
+		return err
+	}
+	return nil
+}
+
+// writeEntry writes header, then header.Size bytes of file from offset. If it
+// fails, the stream cannot be closed.
+func (w *Writer) writeEntry(header *tar.Header, file *os.File, offset int64, progress fileProgress) error {
+	var err error
+	if w.ZeroCopy {
+		err = w.writeDirect(header, file, offset, progress)
+	} else if err = w.WriteHeader(header); err == nil {
+		_, err = io.CopyBuffer(w, io.TeeReader(io.NewSectionReader(file, offset, header.Size), progress), w.copyBuffer())
+	}
+	if err != nil {
+		w.broken = err
+	}
+	return err
+}
+
+// Close ends the stream with the tar trailer, unless an entry was left part
+// written, so that a stream cut short is never taken for a whole one.
+func (w *Writer) Close() error {
+	if w.broken != nil {
+		return fmt.Errorf("tar stream ends part way through an entry: %s", w.broken)
+	}
+	return w.Writer.Close()
+}
+
+// Size returns the total size of the files WriteFiles would write for
+// filePath.
+func Size(filePath string) (int64, error) {
+	_, size, err := Count(filePath)
+	return size, err
+}
+
+// Count returns how many files WriteFiles would write for filePath, and their
+// total size.
+func Count(filePath string) (int, int64, error) {
+	var files int
+	var size int64
+	err := filepath.Walk(filePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	return files, size, err
+}
+
+func (w *Writer) writeDir(filePath string) error {
+	return w.writePipelined(filePath, func(send func(string) bool) error {
+		return filepath.Walk(filePath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() {
+				for _, skip := range w.SkipDirs {
+					if path == skip {
+						return filepath.SkipDir
+					}
+				}
+				return nil
+			}
+
+			if !send(path) {
+				return errStopped
+			}
+			return nil
+		})
+	})
+}
+
+// Checksum returns the hex encoded MD5 checksum of a file.
+func Checksum(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	md5Writer := md5.New()
+
+	if _, err := io.Copy(md5Writer, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(md5Writer.Sum(nil)), nil
+}
+
+// checksum reads file with buf, and returns its hex encoded MD5 checksum.
+func checksum(file io.Reader, buf []byte) (string, error) {
+	md5Writer := md5.New()
+
+	// Hide any WriterTo, so that buf is used.
+	if _, err := io.CopyBuffer(md5Writer, struct{ io.Reader }{file}, buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(md5Writer.Sum(nil)), nil
+}
@@ -0,0 +1,60 @@
+// Package units parses and formats quantities of bytes.
+package units
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type unit struct {
+	suffix string
+	size   int64
+}
+
+// units are checked in order, so binary units come before the decimal units
+// they end with.
+var units = []unit{
+	{"TiB", 1 << 40},
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"TB", 1000 * 1000 * 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"MB", 1000 * 1000},
+	{"KB", 1000},
+	{"B", 1},
+}
+
+var decimalUnits = units[4:8]
+
+// ParseBytes parses a size such as 20MB or 512KiB. A number without a unit is
+// a number of bytes, and an empty string is 0.
+func ParseBytes(size string) (int64, error) {
+	value := strings.TrimSpace(size)
+	if value == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, multiplier = strings.TrimSuffix(value, unit.suffix), unit.size
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 20MB", size)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// FormatBytes formats a size in decimal units, as accepted by ParseBytes.
+func FormatBytes(size int64) string {
+	for _, unit := range decimalUnits {
+		if size >= unit.size {
+			return strconv.FormatFloat(float64(size)/float64(unit.size), 'f', -1, 64) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(size, 10) + "B"
+}
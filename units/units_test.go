@@ -0,0 +1,36 @@
+package units_test
+
+import (
+	"github.com/craigfurman/ezxfer/units"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("byte sizes", func() {
+	It("parses decimal and binary units", func() {
+		for size, expected := range map[string]int64{
+			"20MB":   20 * 1000 * 1000,
+			"1.5KB":  1500,
+			"512KiB": 512 * 1024,
+			"1GiB":   1 << 30,
+			"2TB":    2 * 1000 * 1000 * 1000 * 1000,
+			"100":    100,
+			"100B":   100,
+			"":       0,
+		} {
+			Expect(units.ParseBytes(size)).To(Equal(expected), size)
+		}
+	})
+
+	It("refuses invalid sizes", func() {
+		_, err := units.ParseBytes("big")
+		Expect(err).To(MatchError(`invalid size "big", expected e.g. 20MB`))
+	})
+
+	It("formats sizes", func() {
+		Expect(units.FormatBytes(20 * 1000 * 1000)).To(Equal("20MB"))
+		Expect(units.FormatBytes(1500)).To(Equal("1.5KB"))
+		Expect(units.FormatBytes(100)).To(Equal("100B"))
+		Expect(units.FormatBytes(3 * 1000 * 1000 * 1000 * 1000)).To(Equal("3TB"))
+	})
+})
@@ -0,0 +1,159 @@
+// Package versions keeps previous versions of files that a server overwrites,
+// under a hidden directory in the server's root.
+package versions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DirName is the directory, directly under the server's root, that versions
+// are kept in. Clients may not write to it.
+const DirName = ".ezxfer-versions"
+
+const idFormat = "20060102T150405.000000000Z"
+
+type Store struct {
+	Root string
+	// MaxCount, if non-zero, is the number of versions kept for each path.
+	MaxCount int
+	// MaxAge, if non-zero, is how long versions are kept for.
+	MaxAge time.Duration
+}
+
+type Version struct {
+	ID   string
+	Time time.Time
+	Size int64
+}
+
+// Backup moves the file at relPath, relative to Root, into the versions
+// directory and prunes versions of it beyond the retention limits. Versions
+// of every other file older than MaxAge are pruned too, so that they expire
+// even if their file is never backed up again.
+func (s *Store) Backup(relPath string) error {
+	settle, err := s.Stash(relPath)
+	if err != nil {
+		return err
+	}
+	return settle(true)
+}
+
+// Stash moves the file at relPath into the versions directory, as Backup
+// does, while the file replacing it is received. The returned function
+// prunes versions as Backup does once the new file is saved, or moves the
+// stashed file back in place if it is not.
+func (s *Store) Stash(relPath string) (func(saved bool) error, error) {
+	now := time.Now().UTC()
+	dir := s.versionsDir(relPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	filePath := filepath.Join(s.Root, relPath)
+	versionPath := filepath.Join(dir, now.Format(idFormat))
+	if err := os.Rename(filePath, versionPath); err != nil {
+		return nil, err
+	}
+	return func(saved bool) error {
+		if !saved {
+			return os.Rename(versionPath, filePath)
+		}
+		if err := s.prune(relPath, now); err != nil {
+			return err
+		}
+		return s.pruneExpired(now)
+	}, nil
+}
+
+// List returns the versions kept for relPath, newest first.
+func (s *Store) List(relPath string) ([]Version, error) {
+	files, err := ioutil.ReadDir(s.versionsDir(relPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []Version
+	for _, file := range files {
+		t, err := time.Parse(idFormat, file.Name())
+		if err != nil || file.IsDir() {
+			continue
+		}
+		versions = append(versions, Version{ID: file.Name(), Time: t, Size: file.Size()})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Time.After(versions[j].Time)
+	})
+	return versions, nil
+}
+
+// Restore puts version id of relPath back in place. The current file, if
+// any, is backed up first so that the restore can itself be undone.
+func (s *Store) Restore(relPath, id string) error {
+	versionPath := filepath.Join(s.versionsDir(relPath), id)
+	if _, err := os.Stat(versionPath); err != nil {
+		return fmt.Errorf("no version %s of %s", id, relPath)
+	}
+
+	filePath := filepath.Join(s.Root, relPath)
+	if _, err := os.Stat(filePath); err == nil {
+		if err := s.Backup(relPath); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(versionPath, filePath)
+}
+
+func (s *Store) prune(relPath string, now time.Time) error {
+	versions, err := s.List(relPath)
+	if err != nil {
+		return err
+	}
+
+	for i, version := range versions {
+		tooMany := s.MaxCount > 0 && i >= s.MaxCount
+		tooOld := s.MaxAge > 0 && now.Sub(version.Time) > s.MaxAge
+		if tooMany || tooOld {
+			if err := os.Remove(filepath.Join(s.versionsDir(relPath), version.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneExpired removes the versions of every file older than MaxAge.
+func (s *Store) pruneExpired(now time.Time) error {
+	if s.MaxAge <= 0 {
+		return nil
+	}
+	return filepath.Walk(filepath.Join(s.Root, DirName), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		t, err := time.Parse(idFormat, info.Name())
+		if err != nil || now.Sub(t) <= s.MaxAge {
+			return nil
+		}
+		return os.Remove(path)
+	})
+}
+
+func (s *Store) versionsDir(relPath string) string {
+	return filepath.Join(s.Root, DirName, relPath)
+}
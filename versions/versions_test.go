@@ -0,0 +1,149 @@
+package versions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/craigfurman/ezxfer/testhelpers"
+	"github.com/craigfurman/ezxfer/versions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("file versions", func() {
+	var (
+		root  string
+		store *versions.Store
+	)
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "ezxfer-versions-tests")
+		Expect(err).NotTo(HaveOccurred())
+		store = &versions.Store{Root: root}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	backup := func(content string) {
+		Expect(testhelpers.CreateFile(content, root, "dir", "a.txt")).To(Succeed())
+		Expect(store.Backup(filepath.Join("dir", "a.txt"))).To(Succeed())
+	}
+
+	It("moves backed up files into the versions directory", func() {
+		backup("v1")
+		Expect(filepath.Join(root, "dir", "a.txt")).NotTo(BeAnExistingFile())
+
+		found, err := store.List(filepath.Join("dir", "a.txt"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(HaveLen(1))
+		Expect(found[0].Size).To(Equal(int64(2)))
+		Expect(found[0].Time).To(BeTemporally("~", time.Now(), time.Minute))
+		Expect(filepath.Join(root, versions.DirName, "dir", "a.txt", found[0].ID)).To(BeAnExistingFile())
+	})
+
+	It("lists versions newest first", func() {
+		backup("v1")
+		backup("v22")
+
+		found, err := store.List(filepath.Join("dir", "a.txt"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(HaveLen(2))
+		Expect(found[0].Size).To(Equal(int64(3)))
+		Expect(found[1].Size).To(Equal(int64(2)))
+	})
+
+	It("lists no versions for paths that were never backed up", func() {
+		Expect(store.List("nope.txt")).To(BeEmpty())
+	})
+
+	Context("when a maximum count is set", func() {
+		BeforeEach(func() {
+			store.MaxCount = 2
+		})
+
+		It("removes the oldest versions", func() {
+			backup("v1")
+			backup("v22")
+			backup("v333")
+
+			found, err := store.List(filepath.Join("dir", "a.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(HaveLen(2))
+			Expect(found[0].Size).To(Equal(int64(4)))
+			Expect(found[1].Size).To(Equal(int64(3)))
+		})
+
+		It("moves stashed files back, pruning nothing, if their replacement is not saved", func() {
+			backup("v1")
+			backup("v22")
+			Expect(testhelpers.CreateFile("v333", root, "dir", "a.txt")).To(Succeed())
+
+			settle, err := store.Stash(filepath.Join("dir", "a.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(root, "dir", "a.txt")).NotTo(BeAnExistingFile())
+			Expect(settle(false)).To(Succeed())
+
+			Expect(ioutil.ReadFile(filepath.Join(root, "dir", "a.txt"))).To(Equal([]byte("v333")))
+			found, err := store.List(filepath.Join("dir", "a.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(HaveLen(2))
+			Expect(found[1].Size).To(Equal(int64(2)))
+		})
+	})
+
+	Context("when a maximum age is set", func() {
+		BeforeEach(func() {
+			store.MaxAge = time.Hour
+		})
+
+		It("removes versions older than it", func() {
+			oldID := time.Now().Add(-2 * time.Hour).UTC().Format("20060102T150405.000000000Z")
+			Expect(testhelpers.CreateFile("old", root, versions.DirName, "dir", "a.txt", oldID)).To(Succeed())
+			backup("v1")
+
+			found, err := store.List(filepath.Join("dir", "a.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(HaveLen(1))
+			Expect(found[0].ID).NotTo(Equal(oldID))
+		})
+
+		It("removes old versions of files that are not backed up again", func() {
+			oldID := time.Now().Add(-2 * time.Hour).UTC().Format("20060102T150405.000000000Z")
+			recentID := time.Now().Add(-time.Minute).UTC().Format("20060102T150405.000000000Z")
+			Expect(testhelpers.CreateFile("old", root, versions.DirName, "other", "b.txt", oldID)).To(Succeed())
+			Expect(testhelpers.CreateFile("recent", root, versions.DirName, "other", "b.txt", recentID)).To(Succeed())
+			backup("v1")
+
+			found, err := store.List(filepath.Join("other", "b.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(HaveLen(1))
+			Expect(found[0].ID).To(Equal(recentID))
+		})
+	})
+
+	Describe("restoring", func() {
+		It("puts the version back and backs up the current file", func() {
+			backup("v1")
+			found, err := store.List(filepath.Join("dir", "a.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(testhelpers.CreateFile("current", root, "dir", "a.txt")).To(Succeed())
+
+			Expect(store.Restore(filepath.Join("dir", "a.txt"), found[0].ID)).To(Succeed())
+
+			Expect(ioutil.ReadFile(filepath.Join(root, "dir", "a.txt"))).To(Equal([]byte("v1")))
+			found, err = store.List(filepath.Join("dir", "a.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(HaveLen(1))
+			Expect(found[0].Size).To(Equal(int64(len("current"))))
+		})
+
+		It("returns an error for unknown versions", func() {
+			Expect(store.Restore("a.txt", "nope")).To(MatchError("no version nope of a.txt"))
+		})
+	})
+})